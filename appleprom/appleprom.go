@@ -0,0 +1,85 @@
+// Package appleprom exports the metrics of apple-auth-go to Prometheus.
+//
+// Wire it with:
+//
+//	hook, err := appleprom.NewMetricsHook(prometheus.DefaultRegisterer)
+//	auth, err := apple.New(appID, teamID, keyID, keyPath, apple.WithMetricsHook(hook))
+package appleprom
+
+import (
+	"strconv"
+	"time"
+
+	apple "github.com/GianOrtiz/apple-auth-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "apple_auth"
+
+// MetricsHook is an apple.MetricsHook exporting Prometheus metrics:
+//
+//   - apple_auth_requests_total, requests to Apple by endpoint and status code,
+//     0 when the request failed.
+//   - apple_auth_request_duration_seconds, duration of requests to Apple by
+//     endpoint.
+//   - apple_auth_verifications_total, id token verifications by outcome and
+//     reason.
+//   - apple_auth_client_secrets_generated_total, client secrets signed.
+type MetricsHook struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	verifications   *prometheus.CounterVec
+	clientSecrets   prometheus.Counter
+}
+
+var _ apple.MetricsHook = (*MetricsHook)(nil)
+
+// NewMetricsHook returns a MetricsHook with its metrics registered to the
+// registerer.
+func NewMetricsHook(registerer prometheus.Registerer) (*MetricsHook, error) {
+	h := &MetricsHook{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests to Apple servers by endpoint and status code.",
+		}, []string{"endpoint", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the requests to Apple servers by endpoint.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "verifications_total",
+			Help:      "Id token verifications by outcome and failure reason.",
+		}, []string{"outcome", "reason"}),
+		clientSecrets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_secrets_generated_total",
+			Help:      "Client secrets signed.",
+		}),
+	}
+	for _, collector := range []prometheus.Collector{h.requests, h.requestDuration, h.verifications, h.clientSecrets} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// RequestDone implements apple.MetricsHook.
+func (h *MetricsHook) RequestDone(endpoint string, statusCode int, duration time.Duration) {
+	h.requests.WithLabelValues(endpoint, strconv.Itoa(statusCode)).Inc()
+	h.requestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+}
+
+// VerificationDone implements apple.MetricsHook.
+func (h *MetricsHook) VerificationDone(outcome, reason string) {
+	h.verifications.WithLabelValues(outcome, reason).Inc()
+}
+
+// ClientSecretGenerated implements apple.MetricsHook.
+func (h *MetricsHook) ClientSecretGenerated() {
+	h.clientSecrets.Inc()
+}
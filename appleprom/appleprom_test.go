@@ -0,0 +1,36 @@
+package appleprom
+
+import (
+	"testing"
+	"time"
+
+	apple "github.com/GianOrtiz/apple-auth-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHook(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	hook, err := NewMetricsHook(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook.RequestDone("/auth/token", 200, 100*time.Millisecond)
+	hook.RequestDone("/auth/token", 200, 200*time.Millisecond)
+	hook.RequestDone("/auth/keys", 0, time.Second)
+	hook.VerificationDone(apple.VerificationSuccess, "")
+	hook.VerificationDone(apple.VerificationFailure, "expired")
+	hook.ClientSecretGenerated()
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(hook.requests.WithLabelValues("/auth/token", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(hook.requests.WithLabelValues("/auth/keys", "0")))
+	assert.Equal(t, 2, testutil.CollectAndCount(hook.requestDuration))
+	assert.Equal(t, 1.0, testutil.ToFloat64(hook.verifications.WithLabelValues(apple.VerificationSuccess, "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(hook.verifications.WithLabelValues(apple.VerificationFailure, "expired")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(hook.clientSecrets))
+
+	_, err = NewMetricsHook(registry)
+	assert.Error(t, err)
+}
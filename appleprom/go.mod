@@ -0,0 +1,11 @@
+module github.com/GianOrtiz/apple-auth-go/appleprom
+
+go 1.15
+
+require (
+	github.com/GianOrtiz/apple-auth-go v0.0.0-20261016063745-1075939a7c2d
+	github.com/prometheus/client_golang v1.11.1
+	github.com/stretchr/testify v1.7.0
+)
+
+replace github.com/GianOrtiz/apple-auth-go => ../
@@ -3,14 +3,24 @@
 package apple
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -18,7 +28,40 @@ import (
 
 const (
 	validationEndpoint = "https://appleid.apple.com/auth/token"
+	revokeEndpoint     = "https://appleid.apple.com/auth/revoke"
 	appleAudience      = "https://appleid.apple.com"
+
+	// userAgent the User-Agent header of the requests to Apple servers.
+	userAgent = "apple-auth-go"
+
+	// defaultMaxIdleConnsPerHost the idle connections kept to Apple by the
+	// default HTTP client. All requests go to the same host, so the net/http
+	// default of 2 closes connections needlessly under load.
+	defaultMaxIdleConnsPerHost = 16
+
+	// defaultTimeout the default timeout of the requests to Apple, so a hanging
+	// Apple server does not block callers forever.
+	defaultTimeout = 10 * time.Second
+)
+
+// Grant types supported by Apple token endpoint.
+const (
+	// GrantTypeAuthorizationCode exchanges an authorization code for tokens. It
+	// is used by ValidateCode and ValidateCodeWithRedirectURI.
+	GrantTypeAuthorizationCode = "authorization_code"
+
+	// GrantTypeRefreshToken exchanges a refresh token for a new access token. It
+	// is used by ValidateRefreshToken.
+	GrantTypeRefreshToken = "refresh_token"
+)
+
+// Token type hints of RevokeToken.
+const (
+	// TokenTypeHintRefreshToken the revoked token is a refresh token.
+	TokenTypeHintRefreshToken = "refresh_token"
+
+	// TokenTypeHintAccessToken the revoked token is an access token.
+	TokenTypeHintAccessToken = "access_token"
 )
 
 // AppleAuth is the contract for communication and validation of
@@ -35,10 +78,113 @@ type AppleAuth interface {
 	// ValidateRefreshToken validates a refresh token returning refresh token, access
 	// token and token id.
 	ValidateRefreshToken(refreshToken string) (*TokenResponse, error)
+
+	// ValidateCodeContext validates an authorization code as ValidateCode
+	// does, canceling the request to Apple when ctx is done.
+	ValidateCodeContext(ctx context.Context, code string) (*TokenResponse, error)
+
+	// ValidateCodeWithRedirectURIContext validates an authorization code with
+	// a redirect uri as ValidateCodeWithRedirectURI does, canceling the request
+	// to Apple when ctx is done.
+	ValidateCodeWithRedirectURIContext(ctx context.Context, code, redirectURI string) (*TokenResponse, error)
+
+	// ValidateRefreshTokenContext validates a refresh token as
+	// ValidateRefreshToken does, canceling the request to Apple when ctx is
+	// done.
+	ValidateRefreshTokenContext(ctx context.Context, refreshToken string) (*TokenResponse, error)
+
+	// ValidateCodeFull validates an authorization code, with a redirect uri when
+	// not empty, and verifies the returned id token, returning the tokens along
+	// with the verified user and claims.
+	ValidateCodeFull(ctx context.Context, code, redirectURI string) (*ExchangeResult, error)
+
+	// VerifyAndGetUser verifies the id token against Apple's public keys
+	// returning the user it identifies. Unlike GetUserInfoFromIDToken, it is
+	// safe to use with id tokens received from clients.
+	VerifyAndGetUser(ctx context.Context, idToken string) (*AppleUser, error)
+
+	// UserFromIDToken returns the user of an id token received directly from
+	// Apple once its issuer, audience and expiration are checked, without
+	// verifying its signature.
+	UserFromIDToken(idToken string) (*AppleUser, error)
+
+	// VerifyIDToken verifies the id token against Apple's public keys returning
+	// the user it identifies.
+	VerifyIDToken(ctx context.Context, idToken string) (*AppleUser, error)
+
+	// VerifyIDTokenWithOptions verifies the id token as VerifyIDToken does and
+	// performs the additional checks of opts.
+	VerifyIDTokenWithOptions(ctx context.Context, idToken string, opts VerifyOptions) (*AppleUser, error)
+
+	// VerifyIDTokenDetailed verifies the id token as VerifyIDToken does and
+	// returns it with its key id, algorithm and raw payload.
+	VerifyIDTokenDetailed(ctx context.Context, idToken string) (*VerifiedIDToken, error)
+
+	// VerifyBearer verifies, as VerifyIDToken does, the id token of an
+	// Authorization header value with the Bearer scheme.
+	VerifyBearer(ctx context.Context, authHeader string) (*AppleUser, error)
+
+	// VerifyClaimsInto verifies the id token as VerifyIDToken does and
+	// unmarshals its claims into v.
+	VerifyClaimsInto(ctx context.Context, idToken string, v interface{}) error
+
+	// Exchange sends a request to Apple token endpoint with the given grant type
+	// and parameters, adding the client id and a client secret.
+	Exchange(ctx context.Context, grantType string, params url.Values) (*TokenResponse, error)
+
+	// RevokeToken revokes the refresh or access token of a user, as required
+	// when the user deletes their account.
+	RevokeToken(ctx context.Context, token, tokenTypeHint string) error
+
+	// ExchangeWithClientID sends a request to Apple token endpoint as Exchange
+	// does, on behalf of another app of the team added with WithClientIDs.
+	ExchangeWithClientID(ctx context.Context, clientID, grantType string, params url.Values) (*TokenResponse, error)
+
+	// ParseServerNotification verifies a server to server notification sent by
+	// Apple and returns it.
+	ParseServerNotification(ctx context.Context, payload string) (*ServerNotification, error)
+
+	// AuthorizationURL returns the url of Apple authorize endpoint to redirect
+	// the user to.
+	AuthorizationURL(opts AuthorizationURLOptions) (string, error)
+
+	// SetKey replaces the key used to sign client secrets, validating it first.
+	SetKey(keyID string, key []byte) error
+
+	// ClientSecretTimeToLive returns how long the client secret sent to Apple
+	// remains valid.
+	ClientSecretTimeToLive() (time.Duration, error)
+
+	// KeyThumbprint returns the SHA-256 thumbprint of the configured key public
+	// part.
+	KeyThumbprint() (string, error)
+
+	// SelfTest checks that Apple accepts the client secret signed with the
+	// configured key.
+	SelfTest(ctx context.Context) error
+
+	// ConfigSummary returns a summary of the configuration without the key
+	// material nor the client secrets, for diagnostics.
+	ConfigSummary() string
+
+	// RefreshKeys fetches Apple public keys, replacing the cached ones, for
+	// instance to warm the cache at startup.
+	RefreshKeys(ctx context.Context) error
+
+	// StartKeyRefresher fetches Apple public keys every interval in the
+	// background until Close.
+	StartKeyRefresher(interval time.Duration) error
+
+	// Close stops the background work and zeroes the private key. Any later
+	// call fails with ErrClosed.
+	Close() error
 }
 
+var _ AppleAuth = (*appleAuth)(nil)
+
 type appleErrorResponseBody struct {
-	Error string `json:"error"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 // TokenResponse response when validation was successfull.
@@ -55,153 +201,896 @@ type TokenResponse struct {
 	RefreshToken string `json:"refresh_token"`
 	// TokenType the type of access token.
 	TokenType string `json:"token_type"`
+	// ExpiresAt the time the access token expires, computed from ExpiresIn
+	// and the Date header of the response, or the local clock when it has
+	// none. It is zero when the response has no expires_in. It is not part
+	// of Apple's response, it is encoded as expires_at so a stored token
+	// response keeps its expiry. See UnmarshalJSON.
+	ExpiresAt time.Time `json:"-"`
+	// Header the headers of Apple's response, such as Date, for debugging.
+	// They are not part of Apple's response body.
+	Header http.Header `json:"-"`
+	// Clock returns the current time ExpiresAt is computed from when decoding
+	// a token response without expires_at, and compared with by
+	// TimeUntilExpiry, time.Now when nil. Token responses returned by
+	// AppleAuth have it set to its clock, corrected by the server time offset
+	// with WithPreferServerTime.
+	Clock func() time.Time `json:"-"`
+}
+
+// tokenResponseJSON is the JSON encoding of a TokenResponse, with ExpiresAt as
+// the expires_at unix time.
+type tokenResponseJSON struct {
+	tokenResponseFields
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// tokenResponseFields has the fields of TokenResponse without its methods.
+type tokenResponseFields TokenResponse
+
+// MarshalJSON implements json.Marshaler, encoding ExpiresAt as the expires_at
+// unix time when it is set.
+func (t TokenResponse) MarshalJSON() ([]byte, error) {
+	v := tokenResponseJSON{tokenResponseFields: tokenResponseFields(t)}
+	if !t.ExpiresAt.IsZero() {
+		v.ExpiresAt = t.ExpiresAt.Unix()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. ExpiresAt is read from
+// expires_at, as encoded by MarshalJSON, and otherwise computed from
+// expires_in and the time returned by Clock, so every decoded token response
+// is expiry aware. Set Clock before decoding to inject the time:
+//
+//	res := apple.TokenResponse{Clock: clock}
+//	err := json.Unmarshal(data, &res)
+//
+// expires_in is relative to the time Apple answered, which stored JSON
+// without expires_at, such as Apple's raw response body, does not record: its
+// expiry is computed from the time of decoding, so an old response looks
+// fresh. Store the JSON encoded by MarshalJSON to keep the expiry.
+func (t *TokenResponse) UnmarshalJSON(data []byte) error {
+	var v tokenResponseJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	clock := t.Clock
+	*t = TokenResponse(v.tokenResponseFields)
+	t.Clock = clock
+	switch {
+	case v.ExpiresAt != 0:
+		t.ExpiresAt = time.Unix(v.ExpiresAt, 0)
+	case t.ExpiresIn > 0:
+		t.ExpiresAt = t.now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return nil
+}
+
+// now returns the time of Clock, or of the local clock when nil.
+func (t *TokenResponse) now() time.Time {
+	if t.Clock != nil {
+		return t.Clock()
+	}
+	return time.Now()
+}
+
+// TimeUntilExpiry returns how long until the access token expires, by the
+// time of Clock. The duration is negative when the token already expired or
+// ExpiresAt is not set.
+func (t *TokenResponse) TimeUntilExpiry() time.Duration {
+	return t.ExpiresAt.Sub(t.now())
 }
 
 type httpClient interface {
-	PostForm(url string, data url.Values) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
 type appleAuth struct {
-	AppID      string
-	TeamID     string
-	KeyID      string
-	KeyContent []byte
-	httpClient httpClient
+	AppID             string
+	TeamID            string
+	KeyID             string
+	KeyContent        []byte
+	keyMu             sync.RWMutex
+	privateKey        *ecdsa.PrivateKey
+	signer            crypto.Signer
+	httpClient        httpClient
+	defaultClient     *http.Client
+	transport         *http.Transport
+	tokenEndpoint     string
+	requestDecorator  func(*http.Request)
+	responseValidator func(*TokenResponse) error
+	recorder          *requestRecorder
+	breaker           *circuitBreaker
+	semaphore         chan struct{}
+	maxRetries        int
+	backoff           func(attempt int) time.Duration
+	clientIDs         []string
+	keySource         keySource
+	keysTimeout       time.Duration
+	cache             Cache
+	issuer            string
+	verificationCache *verificationCache
+	clock             func() time.Time
+	serverClock       *serverClock
+	logger            Logger
+	logLevel          LogLevel
+	metrics           MetricsHook
+	lifecycle         lifecycle
+
+	requireNonceSupported bool
+	normalizeEmail        bool
+	stripRelayDots        bool
+	emailClaimName        string
+	validateSubjectFormat bool
+	allowedEmailDomains   map[string]bool
+	maxTokenAge           time.Duration
+
+	minRealUserStatus              RealUserStatus
+	allowUnsupportedRealUserStatus bool
+
+	clientSecretLifetime time.Duration
 }
 
-// Setup and return a new AppleAuth for validation of tokens.
-func New(appID, teamID, keyID, keyPath string) (*appleAuth, error) {
+// Setup and return a new AppleAuth for validation of tokens. The key must be
+// the EC P-256 private key downloaded from the Apple Developer portal,
+// otherwise an error, ErrUnsupportedCurve for keys of other curves, is
+// returned.
+func New(appID, teamID, keyID, keyPath string, opts ...Option) (AppleAuth, error) {
 	keyContent, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	return &appleAuth{
-		KeyID:      keyID,
-		TeamID:     teamID,
-		AppID:      appID,
-		KeyContent: keyContent,
-		httpClient: &http.Client{
-			Timeout: http.DefaultClient.Timeout,
-		},
-	}, nil
+	return NewFromKeyBytes(appID, teamID, keyID, keyContent, opts...)
+}
+
+// NewFromKeyBytes setup and return a new AppleAuth as New does, from the
+// content of the key file instead of its path, for keys read from a secret
+// manager or an environment variable.
+func NewFromKeyBytes(appID, teamID, keyID string, keyContent []byte, opts ...Option) (AppleAuth, error) {
+	return newCheckedAppleAuth(appID, teamID, keyID, keyContent, opts...)
+}
+
+// NewFromEnv setup and return a new AppleAuth configured from the environment
+// variables APPLE_APP_ID, APPLE_TEAM_ID, APPLE_KEY_ID and either APPLE_KEY_PATH,
+// the path of the key file, or APPLE_KEY_PEM, the content of the key.
+func NewFromEnv(opts ...Option) (AppleAuth, error) {
+	var missing []string
+	lookup := func(name string) string {
+		value := os.Getenv(name)
+		if value == "" {
+			missing = append(missing, name)
+		}
+		return value
+	}
+	appID := lookup("APPLE_APP_ID")
+	teamID := lookup("APPLE_TEAM_ID")
+	keyID := lookup("APPLE_KEY_ID")
+	keyPath := os.Getenv("APPLE_KEY_PATH")
+	keyPEM := os.Getenv("APPLE_KEY_PEM")
+	if keyPath == "" && keyPEM == "" {
+		missing = append(missing, "APPLE_KEY_PATH or APPLE_KEY_PEM")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing environment variables: %s", strings.Join(missing, ", "))
+	}
+	if keyPath != "" && keyPEM != "" {
+		return nil, errors.New("only one of APPLE_KEY_PATH and APPLE_KEY_PEM must be set")
+	}
+
+	if keyPEM != "" {
+		return NewFromKeyBytes(appID, teamID, keyID, []byte(keyPEM), opts...)
+	}
+	return New(appID, teamID, keyID, keyPath, opts...)
+}
+
+// NewWebConfig setup and return a new AppleAuth for Sign in with Apple on the
+// web, where the client id is the Services ID configured for the website in
+// the Apple Developer portal, not the bundle id of an app. The Services ID is
+// used as the client id and as the sub of the client secret, which Apple
+// requires to match.
+func NewWebConfig(servicesID, teamID, keyID string, key []byte, opts ...Option) (AppleAuth, error) {
+	switch {
+	case servicesID == "":
+		return nil, errors.New("services id is required")
+	case teamID == "":
+		return nil, errors.New("team id is required")
+	case keyID == "":
+		return nil, ErrKeyIDRequired
+	}
+	return newCheckedAppleAuth(servicesID, teamID, keyID, key, opts...)
+}
+
+// NewWithSigner setup and return a new AppleAuth signing client secrets with
+// the signer instead of a private key in memory, for keys kept in a KMS or an
+// HSM. The signer must hold an EC P-256 key and produce ECDSA signatures,
+// ASN.1 encoded as crypto/ecdsa does or as the concatenation of r and s.
+// SetKey replaces the signer with the given key.
+func NewWithSigner(appID, teamID, keyID string, signer crypto.Signer, opts ...Option) (AppleAuth, error) {
+	if keyID == "" {
+		return nil, ErrKeyIDRequired
+	}
+	if signer == nil {
+		return nil, errors.New("signer is required")
+	}
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("signer public key is not an EC key")
+	}
+	if publicKey.Curve != elliptic.P256() {
+		return nil, ErrUnsupportedCurve
+	}
+	a := newAppleAuth(appID, teamID, keyID, nil, opts...)
+	if err := a.checkConfig(); err != nil {
+		return nil, err
+	}
+	a.signer = signer
+	return a, nil
+}
+
+// NewWithPrivateKey setup and return a new AppleAuth signing client secrets
+// with the already parsed key, for keys loaded and decrypted by the caller.
+// The key must be an EC P-256 key, otherwise ErrUnsupportedCurve is returned.
+func NewWithPrivateKey(appID, teamID, keyID string, key *ecdsa.PrivateKey, opts ...Option) (AppleAuth, error) {
+	if keyID == "" {
+		return nil, ErrKeyIDRequired
+	}
+	if key == nil {
+		return nil, errors.New("private key is required")
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, ErrUnsupportedCurve
+	}
+	a := newAppleAuth(appID, teamID, keyID, nil, opts...)
+	if err := a.checkConfig(); err != nil {
+		return nil, err
+	}
+	a.privateKey = key
+	return a, nil
 }
 
-func (a *appleAuth) clientSecret() (string, error) {
-	block, _ := pem.Decode(a.KeyContent)
+// newCheckedAppleAuth returns a new appleAuth once the key content is checked
+// to be a P-256 private key, so an invalid key is reported at construction
+// rather than on the first request.
+func newCheckedAppleAuth(appID, teamID, keyID string, keyContent []byte, opts ...Option) (AppleAuth, error) {
+	if _, err := parsePrivateKey(keyContent); err != nil {
+		return nil, err
+	}
+	a := newAppleAuth(appID, teamID, keyID, keyContent, opts...)
+	if err := a.checkConfig(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// checkConfig checks the values set by the options.
+func (a *appleAuth) checkConfig() error {
+	if a.clientSecretLifetime <= 0 || a.clientSecretLifetime > maxClientSecretLifetime {
+		return fmt.Errorf("%w: %s", ErrInvalidClientSecretTTL, a.clientSecretLifetime)
+	}
+	if a.keysTimeout <= 0 {
+		return fmt.Errorf("keys timeout must be positive, got %s", a.keysTimeout)
+	}
+	return nil
+}
+
+func newAppleAuth(appID, teamID, keyID string, keyContent []byte, opts ...Option) *appleAuth {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   defaultTimeout,
+	}
+	a := &appleAuth{
+		KeyID:                keyID,
+		TeamID:               teamID,
+		AppID:                appID,
+		KeyContent:           append([]byte(nil), keyContent...),
+		httpClient:           client,
+		defaultClient:        client,
+		transport:            transport,
+		keysTimeout:          defaultKeysTimeout,
+		cache:                NewMemoryCache(),
+		clientSecretLifetime: defaultClientSecretLifetime,
+	}
+	a.keySource = &jwksKeySource{fetch: a.fetchKeys, load: a.loadCachedKeys, start: a.startBackground, now: a.now}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// parsePrivateKey parses the PEM encoded PKCS8 EC private key of an Apple .p8
+// key file.
+func parsePrivateKey(keyContent []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyContent)
 	if block == nil {
-		return "", errors.New("empty block after decoding")
+		return nil, errors.New("empty block after decoding")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	privateKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an EC key")
 	}
+	if privateKey.Curve != elliptic.P256() {
+		return nil, ErrUnsupportedCurve
+	}
+	return privateKey, nil
+}
 
-	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+// KeyThumbprint returns the base64url encoded SHA-256 hash of the DER encoding
+// of the configured key public part. It identifies the key independently of
+// the key id Apple assigned to it.
+func (a *appleAuth) KeyThumbprint() (string, error) {
+	_, signer, err := a.signingKey()
 	if err != nil {
 		return "", err
 	}
+	return keyThumbprint(signer.Public())
+}
 
-	now := time.Now()
+// keyThumbprint returns the base64url encoded SHA-256 hash of the DER encoding
+// of the public key.
+func keyThumbprint(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// signingKey returns the key id and the signer of client secrets, the signer
+// given to NewWithSigner or the parsed private key. The key is parsed once and
+// kept until it is replaced with SetKey.
+func (a *appleAuth) signingKey() (string, crypto.Signer, error) {
+	if err := a.checkOpen(); err != nil {
+		return "", nil, err
+	}
+	a.keyMu.RLock()
+	keyID, privateKey, signer := a.KeyID, a.privateKey, a.signer
+	a.keyMu.RUnlock()
+	if keyID == "" {
+		return "", nil, ErrKeyIDRequired
+	}
+	if signer != nil {
+		return keyID, signer, nil
+	}
+	if privateKey != nil {
+		return keyID, privateKey, nil
+	}
+
+	// The key content is parsed under the lock, as Close zeroes it in place.
+	a.keyMu.Lock()
+	defer a.keyMu.Unlock()
+	if a.KeyID == "" {
+		return "", nil, ErrKeyIDRequired
+	}
+	if a.signer != nil {
+		return a.KeyID, a.signer, nil
+	}
+	if a.privateKey == nil {
+		privateKey, err := parsePrivateKey(a.KeyContent)
+		if err != nil {
+			return "", nil, err
+		}
+		a.privateKey = privateKey
+	}
+	return a.KeyID, a.privateKey, nil
+}
+
+// SetKey replaces the key used to sign client secrets, to rotate it without
+// restarting. The key is validated first, the current key is kept when it is
+// invalid. The key is copied, so the caller keeps ownership of the slice. It
+// is safe to call while requests are in flight, they complete with the key
+// they started with.
+func (a *appleAuth) SetKey(keyID string, key []byte) error {
+	if err := a.checkOpen(); err != nil {
+		return err
+	}
+	if keyID == "" {
+		return ErrKeyIDRequired
+	}
+	privateKey, err := parsePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	a.keyMu.Lock()
+	defer a.keyMu.Unlock()
+	// Close may have zeroed the key since the check above.
+	if err := a.checkOpen(); err != nil {
+		return err
+	}
+	a.KeyID = keyID
+	a.KeyContent = append([]byte(nil), key...)
+	a.privateKey = privateKey
+	a.signer = nil
+	return nil
+}
+
+func (a *appleAuth) clientSecret(ctx context.Context) (string, error) {
+	return a.clientSecretFor(ctx, a.AppID)
+}
+
+// clientSecretFor returns a client secret for the given client id, which
+// Apple requires as sub. Client secrets are kept in the cache and signed again
+// a day before they expire, or when the key changes. The cache is accessed with
+// ctx.
+func (a *appleAuth) clientSecretFor(ctx context.Context, clientID string) (string, error) {
+	keyID, signer, err := a.signingKey()
+	if err != nil {
+		return "", err
+	}
+	thumbprint, err := keyThumbprint(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	cacheKey := cacheKeyPrefix + "client-secret:" + a.TeamID + ":" + keyID + ":" + thumbprint + ":" + clientID
+	if cached, ok := a.cacheGet(ctx, cacheKey); ok {
+		if timeLeft, ok := a.clientSecretTimeLeft(string(cached)); ok && timeLeft > a.clientSecretRenewWindow() {
+			return string(cached), nil
+		}
+	}
+
+	clientSecret, err := a.signClientSecret(keyID, signer, clientID)
+	if err != nil {
+		return "", err
+	}
+	a.cacheSet(ctx, cacheKey, []byte(clientSecret), a.clientSecretLifetime-a.clientSecretRenewWindow())
+	return clientSecret, nil
+}
+
+// signClientSecret signs a client secret for the client id with the key.
+func (a *appleAuth) signClientSecret(keyID string, signer crypto.Signer, clientID string) (string, error) {
+	now := a.now()
 	claims := jwt.StandardClaims{
 		IssuedAt:  now.Unix(),
-		ExpiresAt: now.Add(time.Second * 15776999).Unix(),
+		ExpiresAt: now.Add(a.clientSecretLifetime).Unix(),
 		Issuer:    a.TeamID,
-		Subject:   a.AppID,
+		Subject:   clientID,
 		Audience:  appleAudience,
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, &claims)
+	token := jwt.NewWithClaims(signingMethodES256Signer, &claims)
 	token.Header["alg"] = "ES256"
-	token.Header["kid"] = a.KeyID
-	clientSecret, err := token.SignedString(privateKey)
+	token.Header["kid"] = keyID
+	clientSecret, err := token.SignedString(signer)
 	if err != nil {
 		return "", err
 	}
+	if a.metrics != nil {
+		a.metrics.ClientSecretGenerated()
+	}
 	return clientSecret, nil
 }
 
 func (a *appleAuth) ValidateCode(code string) (*TokenResponse, error) {
-	clientSecret, err := a.clientSecret()
+	return a.ValidateCodeContext(context.Background(), code)
+}
+
+func (a *appleAuth) ValidateCodeContext(ctx context.Context, code string) (*TokenResponse, error) {
+	clientSecret, err := a.clientSecret(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return a.validateCode(clientSecret, code)
+	return a.validateCode(ctx, clientSecret, code)
 }
 
-func (a *appleAuth) validateCode(clientSecret, code string) (*TokenResponse, error) {
-	formQuery := make(url.Values)
-	formQuery.Add("client_id", a.AppID)
-	formQuery.Add("client_secret", clientSecret)
-	formQuery.Add("code", code)
-	formQuery.Add("grant_type", "authorization_code")
-	return a.validateRequest(formQuery)
+func (a *appleAuth) validateCode(ctx context.Context, clientSecret, code string) (*TokenResponse, error) {
+	params := make(url.Values)
+	params.Add("code", code)
+	return a.exchange(ctx, clientSecret, GrantTypeAuthorizationCode, params)
 }
 
 func (a *appleAuth) ValidateCodeWithRedirectURI(code, redirectURI string) (*TokenResponse, error) {
-	clientSecret, err := a.clientSecret()
+	return a.ValidateCodeWithRedirectURIContext(context.Background(), code, redirectURI)
+}
+
+func (a *appleAuth) ValidateCodeWithRedirectURIContext(ctx context.Context, code, redirectURI string) (*TokenResponse, error) {
+	clientSecret, err := a.clientSecret(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return a.validateCodeWithRedirectURI(clientSecret, code, redirectURI)
+	return a.validateCodeWithRedirectURI(ctx, clientSecret, code, redirectURI)
 }
 
-func (a *appleAuth) validateCodeWithRedirectURI(clientSecret, code, redirectURI string) (*TokenResponse, error) {
-	formQuery := make(url.Values)
-	formQuery.Add("client_id", a.AppID)
-	formQuery.Add("client_secret", clientSecret)
-	formQuery.Add("code", code)
-	formQuery.Add("grant_type", "authorization_code")
-	formQuery.Add("redirect_uri", redirectURI)
-	return a.validateRequest(formQuery)
+func (a *appleAuth) validateCodeWithRedirectURI(ctx context.Context, clientSecret, code, redirectURI string) (*TokenResponse, error) {
+	params := make(url.Values)
+	params.Add("code", code)
+	params.Add("redirect_uri", redirectURI)
+	return a.exchange(ctx, clientSecret, GrantTypeAuthorizationCode, params)
 }
 
 func (a *appleAuth) ValidateRefreshToken(refreshToken string) (*TokenResponse, error) {
-	clientSecret, err := a.clientSecret()
+	return a.ValidateRefreshTokenContext(context.Background(), refreshToken)
+}
+
+func (a *appleAuth) ValidateRefreshTokenContext(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	clientSecret, err := a.clientSecret(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return a.validateRefreshToken(clientSecret, refreshToken)
+	return a.validateRefreshToken(ctx, clientSecret, refreshToken)
 }
 
-func (a *appleAuth) validateRefreshToken(clientSecret, refreshToken string) (*TokenResponse, error) {
-	formQuery := make(url.Values)
-	formQuery.Add("client_id", a.AppID)
-	formQuery.Add("client_secret", clientSecret)
-	formQuery.Add("refresh_token", refreshToken)
-	formQuery.Add("grant_type", "refresh_token")
-	return a.validateRequest(formQuery)
+func (a *appleAuth) validateRefreshToken(ctx context.Context, clientSecret, refreshToken string) (*TokenResponse, error) {
+	params := make(url.Values)
+	params.Add("refresh_token", refreshToken)
+	return a.exchange(ctx, clientSecret, GrantTypeRefreshToken, params)
+}
+
+// Exchange sends a request to Apple token endpoint with the given grant type
+// and parameters, adding the client id and a client secret. It supports flows
+// not covered by the other methods, and parameters Apple may add in the
+// future.
+//
+// Every parameter in params is sent as is, except client_id, client_secret and
+// grant_type which are always set by the package and can't be overridden.
+func (a *appleAuth) Exchange(ctx context.Context, grantType string, params url.Values) (*TokenResponse, error) {
+	clientSecret, err := a.clientSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.exchange(ctx, clientSecret, grantType, params)
 }
 
-func (a *appleAuth) validateRequest(formQuery url.Values) (*TokenResponse, error) {
-	res, err := a.httpClient.PostForm(validationEndpoint, formQuery)
+// ExchangeWithClientID sends a request to Apple token endpoint as Exchange
+// does, on behalf of another app of the team. The client id must be the app
+// id or one of the client ids added with WithClientIDs, otherwise
+// ErrUnknownClientID is returned. The client secret is signed for that client
+// id.
+func (a *appleAuth) ExchangeWithClientID(ctx context.Context, clientID, grantType string, params url.Values) (*TokenResponse, error) {
+	if !a.hasClientID(clientID) {
+		return nil, ErrUnknownClientID
+	}
+	clientSecret, err := a.clientSecretFor(ctx, clientID)
 	if err != nil {
 		return nil, err
 	}
+	return a.exchangeFor(ctx, clientID, clientSecret, grantType, params)
+}
+
+// hasClientID reports whether the client id is the app id or one of the
+// client ids added with WithClientIDs.
+func (a *appleAuth) hasClientID(clientID string) bool {
+	if clientID == a.AppID {
+		return true
+	}
+	for _, id := range a.clientIDs {
+		if clientID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *appleAuth) exchange(ctx context.Context, clientSecret, grantType string, params url.Values) (*TokenResponse, error) {
+	return a.exchangeFor(ctx, a.AppID, clientSecret, grantType, params)
+}
+
+func (a *appleAuth) exchangeFor(ctx context.Context, clientID, clientSecret, grantType string, params url.Values) (*TokenResponse, error) {
+	if a.clientSecretExpired(clientSecret) {
+		return nil, ErrClientSecretExpired
+	}
+	formQuery := make(url.Values)
+	for name, values := range params {
+		formQuery[name] = values
+	}
+	formQuery.Set("client_id", clientID)
+	formQuery.Set("client_secret", clientSecret)
+	formQuery.Set("grant_type", grantType)
+	tokenResponse, err := a.validateRequest(ctx, formQuery)
+	if errors.Is(err, ErrorResponseInvalidClient) {
+		return nil, a.invalidClientError(clientSecret, err)
+	}
+	return tokenResponse, err
+}
+
+// RevokeToken revokes the token, a refresh token or an access token as told by
+// tokenTypeHint, TokenTypeHintRefreshToken or TokenTypeHintAccessToken, with
+// Apple revoke endpoint. Apps must revoke the tokens of users deleting their
+// account. Apple errors are returned as the ErrorResponse errors of the token
+// endpoint.
+func (a *appleAuth) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	clientSecret, err := a.clientSecret(ctx)
+	if err != nil {
+		return err
+	}
+	if a.clientSecretExpired(clientSecret) {
+		return ErrClientSecretExpired
+	}
+	formQuery := make(url.Values)
+	formQuery.Set("client_id", a.AppID)
+	formQuery.Set("client_secret", clientSecret)
+	formQuery.Set("token", token)
+	if tokenTypeHint != "" {
+		formQuery.Set("token_type_hint", tokenTypeHint)
+	}
+	req, err := a.newFormRequest(ctx, revokeEndpoint, formQuery)
+	if err != nil {
+		return err
+	}
+	// Revoking a token twice is harmless, the request can be retried.
+	res, err := a.do(req, true)
+	if err != nil {
+		return fmt.Errorf("revoking token: %w", err)
+	}
 	defer func() {
 		_ = res.Body.Close()
 	}()
 
 	if res.StatusCode != http.StatusOK {
-		var errorResponseBody appleErrorResponseBody
-		if err := json.NewDecoder(res.Body).Decode(&errorResponseBody); err != nil {
+		err := errorFromResponse(res)
+		if errors.Is(err, ErrorResponseInvalidClient) {
+			return a.invalidClientError(clientSecret, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// invalidClientError explains an invalid_client response. Client secrets
+// expiring after 6 months are its most common cause in production: the error
+// is ErrClientSecretExpired when the client secret sent is expired, otherwise
+// the invalid_client error with a hint about it.
+func (a *appleAuth) invalidClientError(clientSecret string, err error) error {
+	if a.clientSecretExpired(clientSecret) {
+		return fmt.Errorf("%w: Apple answered invalid_client, regenerate the client secret", ErrClientSecretExpired)
+	}
+	return fmt.Errorf("%w (if the client secret was signed more than 6 months ago it expired and must be regenerated)", err)
+}
+
+// responseTime returns the time Apple sent the response, from its Date header,
+// so the expiry of the tokens does not depend on the skew of the local clock.
+// It falls back to now when the header is missing or invalid.
+func responseTime(res *http.Response, now time.Time) time.Time {
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return now
+	}
+	return date
+}
+
+// errorFromResponse builds the error of a failed response from Apple. Bodies
+// that are not JSON, such as the HTML pages served during outages, and errors
+// not documented by Apple result in an *UnexpectedResponseError.
+func errorFromResponse(res *http.Response) error {
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+	if err != nil {
+		return err
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "" && !strings.Contains(contentType, "json") {
+		return newUnexpectedResponseError(res.StatusCode, body)
+	}
+
+	var errorResponseBody appleErrorResponseBody
+	if err := json.Unmarshal(body, &errorResponseBody); err != nil {
+		return newUnexpectedResponseError(res.StatusCode, body)
+	}
+	description := errorResponseBody.ErrorDescription
+	switch errorResponseBody.Error {
+	case string(ErrorResponseTypeInvalidScope):
+		return ErrorResponseInvalidScope.withDescription(description)
+	case string(ErrorResponseTypeUnsupportedGrantType):
+		return ErrorResponseUnsupportedGrantType.withDescription(description)
+	case string(ErrorResponseTypeUnauthorizedClient):
+		return ErrorResponseUnauthorizedClient.withDescription(description)
+	case string(ErrorResponseTypeInvalidGrant):
+		if strings.Contains(strings.ToLower(description), "redirect") {
+			return redirectURIMismatchError{response: ErrorResponseInvalidGrant.withDescription(description)}
+		}
+		return ErrorResponseInvalidGrant.withDescription(description)
+	case string(ErrorResponseTypeInvalidClient):
+		return ErrorResponseInvalidClient.withDescription(description)
+	case string(ErrorResponseTypeInvalidRequest):
+		return ErrorResponseInvalidRequest.withDescription(description)
+	default:
+		return newUnexpectedResponseError(res.StatusCode, body)
+	}
+}
+
+// SelfTest sends a refresh token request with an invalid refresh token to
+// check that Apple authenticates the client. Apple answers invalid_grant once
+// the client secret is accepted, which makes the self test pass, and
+// invalid_client when it is not, which most often means the key id does not
+// belong to the private key, or the team id or app id are wrong.
+//
+// Apple does not expose the key id of a private key, so a mismatch can only be
+// detected by asking Apple. Running it at startup surfaces the
+// misconfiguration before the first user signs in. The client secret
+// structure is checked locally first, see ErrInvalidClientSecret.
+func (a *appleAuth) SelfTest(ctx context.Context) error {
+	clientSecret, err := a.clientSecret(ctx)
+	if err != nil {
+		return err
+	}
+	if err := validateClientSecret(clientSecret, a.TeamID, a.AppID, a.now()); err != nil {
+		return err
+	}
+	_, err = a.validateRefreshToken(ctx, clientSecret, "apple-auth-go-self-test")
+	switch {
+	case err == nil, errors.Is(err, ErrorResponseInvalidGrant):
+		return nil
+	case errors.Is(err, ErrorResponseInvalidClient):
+		// The client secret was just checked, so it did not expire.
+		a.keyMu.RLock()
+		keyID := a.KeyID
+		a.keyMu.RUnlock()
+		invalidClient := ErrorResponseInvalidClient
+		errors.As(err, &invalidClient)
+		return fmt.Errorf("%w: check that the key id %q belongs to the private key and that the team id and app id are correct", invalidClient, keyID)
+	default:
+		return err
+	}
+}
+
+// newRequest builds a request to Apple servers with the package user agent and
+// applies the request decorator, if any, which can override the headers.
+func (a *appleAuth) newRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Request, error) {
+	if err := a.checkOpen(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if a.requestDecorator != nil {
+		a.requestDecorator(req)
+	}
+	return req, nil
+}
+
+// newFormRequest builds a POST request with the form encoded as its body.
+func (a *appleAuth) newFormRequest(ctx context.Context, endpoint string, formQuery url.Values) (*http.Request, error) {
+	return a.newRequest(ctx, http.MethodPost, endpoint, strings.NewReader(formQuery.Encode()))
+}
+
+// tokenURL returns the url of the token endpoint set with WithTokenEndpoint,
+// Apple's by default.
+func (a *appleAuth) tokenURL() string {
+	if a.tokenEndpoint != "" {
+		return a.tokenEndpoint
+	}
+	return validationEndpoint
+}
+
+// do sends the request to Apple servers, retrying transient failures up to the
+// configured number of retries. Requests that are not idempotent are only
+// retried when they failed before being sent.
+func (a *appleAuth) do(req *http.Request, idempotent bool) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := a.doOnce(req)
+		if attempt > a.maxRetries || !isRetryable(req, res, err, idempotent) {
+			return res, err
+		}
+		delay, ok := a.retryDelay(req.Context(), attempt)
+		if !ok {
+			return res, err
+		}
+		retryReq, ok := rewindRequest(req)
+		if !ok {
+			return res, err
+		}
+		drainResponse(res)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		req = retryReq
+	}
+}
+
+// doOnce sends the request to Apple servers once.
+func (a *appleAuth) doOnce(req *http.Request) (*http.Response, error) {
+	if a.breaker != nil {
+		if err := a.breaker.allow(); err != nil {
 			return nil, err
 		}
-		switch errorResponseBody.Error {
-		case string(ErrorResponseTypeInvalidScope):
-			return nil, ErrorResponseInvalidScope
-		case string(ErrorResponseTypeUnsupportedGrantType):
-			return nil, ErrorResponseUnsupportedGrantType
-		case string(ErrorResponseTypeUnauthorizedClient):
-			return nil, ErrorResponseUnauthorizedClient
-		case string(ErrorResponseTypeInvalidGrant):
-			return nil, ErrorResponseInvalidGrant
-		case string(ErrorResponseTypeInvalidClient):
-			return nil, ErrorResponseInvalidClient
-		case string(ErrorResponseTypeInvalidRequest):
-			return nil, ErrorResponseInvalidRequest
-		default:
-			return nil, fmt.Errorf("unrecognized response error: %s", errorResponseBody.Error)
+	}
+	if a.semaphore != nil {
+		select {
+		case a.semaphore <- struct{}{}:
+		case <-req.Context().Done():
+			if a.breaker != nil {
+				a.breaker.done(outcomeIgnored)
+			}
+			return nil, req.Context().Err()
+		}
+	}
+	start := time.Now()
+	res, err := a.httpClient.Do(req)
+	if a.semaphore != nil {
+		// The slot is held until the response body is closed, so bodies being
+		// read count as requests in flight.
+		if err != nil {
+			<-a.semaphore
+		} else {
+			res.Body = &releasingBody{ReadCloser: res.Body, release: func() { <-a.semaphore }}
 		}
 	}
+	a.recordRequest(req, res, time.Since(start))
+	a.observeServerTime(res)
+	if a.recorder != nil {
+		a.recorder.record(req, res, err)
+	}
+	if a.breaker != nil {
+		a.breaker.done(requestOutcomeOf(req, res, err))
+	}
+	return res, err
+}
+
+// releasingBody is a response body calling release once it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// requestOutcomeOf classifies the result of a request for the circuit breaker.
+func requestOutcomeOf(req *http.Request, res *http.Response, err error) requestOutcome {
+	switch {
+	case req.Context().Err() != nil:
+		return outcomeIgnored
+	case err != nil || res.StatusCode >= http.StatusInternalServerError:
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
 
-	var tokenResponse TokenResponse
-	if err := json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+func (a *appleAuth) validateRequest(ctx context.Context, formQuery url.Values) (*TokenResponse, error) {
+	req, err := a.newFormRequest(ctx, a.tokenURL(), formQuery)
+	if err != nil {
 		return nil, err
 	}
+	// Authorization codes are single use, Apple may have consumed the code
+	// of a request that failed after being sent.
+	res, err := a.do(req, formQuery.Get("grant_type") != GrantTypeAuthorizationCode)
+	if err != nil {
+		return nil, fmt.Errorf("requesting token: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(res)
+	}
+
+	// The expiry is computed from the time Apple answered.
+	received := responseTime(res, a.now())
+	tokenResponse := TokenResponse{Clock: func() time.Time { return received }}
+	if err := json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+	tokenResponse.Clock = a.now
+	tokenResponse.Header = res.Header
+	// Refresh responses legitimately omit the id and refresh tokens, but a code
+	// grant without them leaves nothing to identify the user with.
+	if formQuery.Get("grant_type") == GrantTypeAuthorizationCode && (tokenResponse.IDToken == "" || tokenResponse.RefreshToken == "") {
+		return nil, ErrIncompleteTokenResponse
+	}
+	if a.responseValidator != nil {
+		if err := a.responseValidator(&tokenResponse); err != nil {
+			return nil, err
+		}
+	}
 	return &tokenResponse, nil
 }
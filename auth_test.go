@@ -2,13 +2,30 @@ package apple
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -18,9 +35,18 @@ type MockedHTTPClient struct {
 	mock.Mock
 }
 
-// Mocked function PostForm that does not call any server, just return the expected response.
-func (m *MockedHTTPClient) PostForm(url string, data url.Values) (resp *http.Response, err error) {
-	args := m.Mock.Called(url, data)
+// Mocked function Do that does not call any server, just return the expected response.
+// The expectations are set on the request URL and its decoded form body.
+func (m *MockedHTTPClient) Do(req *http.Request) (resp *http.Response, err error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	data, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	args := m.Mock.Called(req.URL.String(), data)
 
 	resArg := args.Get(0)
 	resp, ok := resArg.(*http.Response)
@@ -34,13 +60,16 @@ func (m *MockedHTTPClient) PostForm(url string, data url.Values) (resp *http.Res
 
 const mockClientSecret = "client-secret"
 
+// codeGrantResponse is the minimal successful response to an authorization code grant.
+var codeGrantResponse = TokenResponse{IDToken: "id-token", RefreshToken: "refresh-token"}
+
 func TestValidateRequest(t *testing.T) {
 	form := make(url.Values)
 
 	tokenResponse := TokenResponse{}
 	tokenResponseBody, _ := json.Marshal(tokenResponse)
 	mockedHTTPClient := new(MockedHTTPClient)
-	mockedHTTPClient.On("PostForm", validationEndpoint, form).Return(
+	mockedHTTPClient.On("Do", validationEndpoint, form).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -55,7 +84,7 @@ func TestValidateRequest(t *testing.T) {
 		KeyContent: []byte{},
 		httpClient: mockedHTTPClient,
 	}
-	res, err := auth.validateRequest(form)
+	res, err := auth.validateRequest(context.Background(), form)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
@@ -63,7 +92,7 @@ func TestValidateRequest(t *testing.T) {
 func TestValidateCode(t *testing.T) {
 	code := "apple-authorization-code"
 
-	tokenResponse := TokenResponse{}
+	tokenResponse := codeGrantResponse
 	tokenResponseBody, _ := json.Marshal(tokenResponse)
 	mockedHTTPClient := new(MockedHTTPClient)
 
@@ -79,7 +108,7 @@ func TestValidateCode(t *testing.T) {
 	reqForm.Add("client_secret", mockClientSecret)
 	reqForm.Add("code", code)
 	reqForm.Add("grant_type", "authorization_code")
-	mockedHTTPClient.On("PostForm", validationEndpoint, reqForm).Return(
+	mockedHTTPClient.On("Do", validationEndpoint, reqForm).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -87,7 +116,7 @@ func TestValidateCode(t *testing.T) {
 		nil,
 	)
 
-	res, err := auth.validateCode(mockClientSecret, code)
+	res, err := auth.validateCode(context.Background(), mockClientSecret, code)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
@@ -96,7 +125,7 @@ func TestValidateCodeWithRedirectURI(t *testing.T) {
 	code := "apple-authorization-code"
 	redirectURI := "https://saladeestar.app/apple"
 
-	tokenResponse := TokenResponse{}
+	tokenResponse := codeGrantResponse
 	tokenResponseBody, _ := json.Marshal(tokenResponse)
 	mockedHTTPClient := new(MockedHTTPClient)
 
@@ -113,7 +142,7 @@ func TestValidateCodeWithRedirectURI(t *testing.T) {
 	reqForm.Add("code", code)
 	reqForm.Add("grant_type", "authorization_code")
 	reqForm.Add("redirect_uri", redirectURI)
-	mockedHTTPClient.On("PostForm", validationEndpoint, reqForm).Return(
+	mockedHTTPClient.On("Do", validationEndpoint, reqForm).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -121,7 +150,7 @@ func TestValidateCodeWithRedirectURI(t *testing.T) {
 		nil,
 	)
 
-	res, err := auth.validateCodeWithRedirectURI(mockClientSecret, code, redirectURI)
+	res, err := auth.validateCodeWithRedirectURI(context.Background(), mockClientSecret, code, redirectURI)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
@@ -145,7 +174,7 @@ func TestValidateRefreshToken(t *testing.T) {
 	reqForm.Add("client_secret", mockClientSecret)
 	reqForm.Add("refresh_token", refreshToken)
 	reqForm.Add("grant_type", "refresh_token")
-	mockedHTTPClient.On("PostForm", validationEndpoint, reqForm).Return(
+	mockedHTTPClient.On("Do", validationEndpoint, reqForm).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -153,7 +182,1083 @@ func TestValidateRefreshToken(t *testing.T) {
 		nil,
 	)
 
-	res, err := auth.validateRefreshToken(mockClientSecret, refreshToken)
+	res, err := auth.validateRefreshToken(context.Background(), mockClientSecret, refreshToken)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
+
+// Function adapter satisfying the httpClient interface, handy when a test needs to inspect the
+// whole request instead of only its URL and form.
+type httpClientFunc func(req *http.Request) (*http.Response, error)
+
+func (f httpClientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestValidateRequest_RequestDecorator(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(TokenResponse{})
+	var sentReq *http.Request
+	auth := appleAuth{
+		AppID:      "appID",
+		TeamID:     "teamID",
+		KeyID:      "keyID",
+		KeyContent: []byte{},
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			sentReq = req
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+			}, nil
+		}),
+	}
+	WithRequestDecorator(func(req *http.Request) {
+		req.URL, _ = url.Parse("https://gateway.internal/apple/auth/token")
+		req.Header.Set("X-Gateway-Auth", "gateway-secret")
+	})(&auth)
+
+	form := make(url.Values)
+	form.Add("client_secret", mockClientSecret)
+	_, err := auth.validateRequest(context.Background(), form)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "https://gateway.internal/apple/auth/token", sentReq.URL.String())
+	assert.Equal(t, "gateway-secret", sentReq.Header.Get("X-Gateway-Auth"))
+	assert.Equal(t, "application/x-www-form-urlencoded", sentReq.Header.Get("Content-Type"))
+	assert.NoError(t, sentReq.ParseForm())
+	assert.Equal(t, mockClientSecret, sentReq.PostForm.Get("client_secret"))
+}
+
+func TestValidateRequest_ResponseValidator(t *testing.T) {
+	form := make(url.Values)
+
+	tokenResponse := TokenResponse{AccessToken: "access-token", TokenType: "Bearer"}
+	tokenResponseBody, _ := json.Marshal(tokenResponse)
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockedHTTPClient.On("Do", validationEndpoint, form).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		},
+		nil,
+	)
+
+	errMissingIDToken := errors.New("missing id_token")
+	auth := appleAuth{
+		AppID:      "appID",
+		TeamID:     "teamID",
+		KeyID:      "keyID",
+		KeyContent: []byte{},
+		httpClient: mockedHTTPClient,
+	}
+	WithResponseValidator(func(res *TokenResponse) error {
+		if res.IDToken == "" {
+			return errMissingIDToken
+		}
+		return nil
+	})(&auth)
+
+	res, err := auth.validateRequest(context.Background(), form)
+	assert.Equal(t, errMissingIDToken, err)
+	assert.Nil(t, res)
+}
+
+// Sets the environment variables for the duration of the test, an empty value unsets the variable.
+func setTestEnv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		previous, ok := os.LookupEnv(name)
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	keyContent := newTestKeyContent(t)
+	keyPath := filepath.Join(t.TempDir(), "key.p8")
+	if err := ioutil.WriteFile(keyPath, keyContent, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, keyEnv := range map[string]map[string]string{
+		"key path": {"APPLE_KEY_PATH": keyPath, "APPLE_KEY_PEM": ""},
+		"key pem":  {"APPLE_KEY_PATH": "", "APPLE_KEY_PEM": string(keyContent)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setTestEnv(t, map[string]string{"APPLE_APP_ID": "appID", "APPLE_TEAM_ID": "teamID", "APPLE_KEY_ID": "keyID"})
+			setTestEnv(t, keyEnv)
+
+			auth, err := NewFromEnv()
+			assert.NoError(t, err)
+			a := auth.(*appleAuth)
+			assert.Equal(t, "appID", a.AppID)
+			assert.Equal(t, "teamID", a.TeamID)
+			assert.Equal(t, "keyID", a.KeyID)
+			assert.Equal(t, keyContent, a.KeyContent)
+		})
+	}
+}
+
+func TestNewFromEnv_Missing(t *testing.T) {
+	setTestEnv(t, map[string]string{
+		"APPLE_APP_ID":   "appID",
+		"APPLE_TEAM_ID":  "",
+		"APPLE_KEY_ID":   "",
+		"APPLE_KEY_PATH": "",
+		"APPLE_KEY_PEM":  "",
+	})
+
+	_, err := NewFromEnv()
+	assert.EqualError(t, err, "missing environment variables: APPLE_TEAM_ID, APPLE_KEY_ID, APPLE_KEY_PATH or APPLE_KEY_PEM")
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		expectErr error
+	}{
+		{"client accepted", http.StatusBadRequest, `{"error":"invalid_grant"}`, nil},
+		{"client rejected", http.StatusBadRequest, `{"error":"invalid_client"}`, ErrorResponseInvalidClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sentForm url.Values
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				_ = req.ParseForm()
+				sentForm = req.PostForm
+				return &http.Response{
+					StatusCode: tt.status,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(tt.body))),
+				}, nil
+			})
+
+			err := auth.SelfTest(context.Background())
+			if tt.expectErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tt.expectErr))
+				assert.Contains(t, err.Error(), `key id "keyID"`)
+			}
+			assert.Equal(t, "refresh_token", sentForm.Get("grant_type"))
+			assert.NotEmpty(t, sentForm.Get("client_secret"))
+		})
+	}
+}
+
+func TestClientSecret_KeyIDRequired(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "", newTestKeyContent(t))
+	_, err := auth.clientSecret(context.Background())
+	assert.Equal(t, ErrKeyIDRequired, err)
+}
+
+func TestClientSecret_KeyIDHeader(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	clientSecret, err := auth.clientSecret(context.Background())
+	assert.NoError(t, err)
+	token, err := decodeJWT(clientSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, jwtHeader{Algorithm: "ES256", KeyID: "keyID"}, token.header)
+}
+
+func TestExchange(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(TokenResponse{})
+	mockedHTTPClient := new(MockedHTTPClient)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = mockedHTTPClient
+	mockedHTTPClient.On("Do", validationEndpoint, mock.MatchedBy(func(form url.Values) bool {
+		return form.Get("client_id") == "appID" &&
+			form.Get("client_secret") != "" &&
+			form.Get("grant_type") == GrantTypeRefreshToken &&
+			form.Get("refresh_token") == "refresh-token" &&
+			form.Get("scope") == "name email"
+	})).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		},
+		nil,
+	)
+
+	params := make(url.Values)
+	params.Add("refresh_token", "refresh-token")
+	params.Add("scope", "name email")
+	res, err := auth.Exchange(context.Background(), GrantTypeRefreshToken, params)
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	mockedHTTPClient.AssertExpectations(t)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const maxConcurrency = 3
+	var (
+		mu               sync.Mutex
+		inFlight, peak   int
+		tokenResponse, _ = json.Marshal(TokenResponse{})
+	)
+	auth := appleAuth{
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader(tokenResponse)),
+			}, nil
+		}),
+	}
+	WithMaxConcurrency(maxConcurrency)(&auth)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := auth.validateRequest(context.Background(), make(url.Values))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, maxConcurrency, peak)
+}
+
+func TestMaxConcurrency_ContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	auth := appleAuth{
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			<-release
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))}, nil
+		}),
+	}
+	WithMaxConcurrency(1)(&auth)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = auth.validateRequest(context.Background(), make(url.Values))
+	}()
+	for len(auth.semaphore) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := auth.validateRequest(ctx, make(url.Values))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	close(release)
+	<-done
+}
+
+func TestMaxConcurrency_HeldUntilBodyClosed(t *testing.T) {
+	auth := appleAuth{
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))}, nil
+		}),
+	}
+	WithMaxConcurrency(1)(&auth)
+	req, err := http.NewRequest(http.MethodGet, keysEndpoint, nil)
+	assert.NoError(t, err)
+
+	res, err := auth.doOnce(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(auth.semaphore))
+	assert.NoError(t, res.Body.Close())
+	assert.NoError(t, res.Body.Close())
+	assert.Equal(t, 0, len(auth.semaphore))
+}
+
+func TestKeyThumbprint(t *testing.T) {
+	keyContent := newTestKeyContent(t)
+	privateKey, err := parsePrivateKey(keyContent)
+	assert.NoError(t, err)
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	sum := sha256.Sum256(der)
+
+	auth := newAppleAuth("appID", "teamID", "keyID", keyContent)
+	thumbprint, err := auth.KeyThumbprint()
+	assert.NoError(t, err)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), thumbprint)
+
+	otherThumbprint, err := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t)).KeyThumbprint()
+	assert.NoError(t, err)
+	assert.NotEqual(t, thumbprint, otherThumbprint)
+
+	_, err = newAppleAuth("appID", "teamID", "keyID", []byte("not a key")).KeyThumbprint()
+	assert.Error(t, err)
+}
+
+func TestValidateRequest_HTMLErrorPage(t *testing.T) {
+	page := "<html><head><title>503 Service Temporarily Unavailable</title></head><body>" + strings.Repeat("<p>Apple is down</p>", 100) + "</body></html>"
+	auth := appleAuth{
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Header:     http.Header{"Content-Type": []string{"text/html; charset=UTF-8"}},
+				Body:       ioutil.NopCloser(strings.NewReader(page)),
+			}, nil
+		}),
+	}
+
+	_, err := auth.validateRequest(context.Background(), make(url.Values))
+	var unexpectedErr *UnexpectedResponseError
+	assert.True(t, errors.As(err, &unexpectedErr))
+	assert.Equal(t, http.StatusServiceUnavailable, unexpectedErr.StatusCode)
+	assert.True(t, strings.HasPrefix(unexpectedErr.Body, "<html><head><title>503 Service Temporarily Unavailable</title>"))
+	assert.Equal(t, maxErrorBodySnippetSize+len("..."), len(unexpectedErr.Body))
+}
+
+func TestValidateRequest_UnexpectedErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"proxy page without content type", http.StatusBadGateway, "", "<html><body>502 Bad Gateway</body></html>"},
+		{"html labelled as json", http.StatusInternalServerError, "application/json", "<html><body>Internal Server Error</body></html>"},
+		{"empty body", http.StatusServiceUnavailable, "application/json", ""},
+		{"plain text", http.StatusGatewayTimeout, "text/plain", "upstream request timeout"},
+		{"unrecognized error", http.StatusBadRequest, "application/json", `{"error":"invalid_token"}`},
+		{"json without error", http.StatusInternalServerError, "application/json", `{"message":"internal error"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := appleAuth{
+				httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+					header := http.Header{}
+					if tt.contentType != "" {
+						header.Set("Content-Type", tt.contentType)
+					}
+					return &http.Response{
+						StatusCode: tt.status,
+						Header:     header,
+						Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+					}, nil
+				}),
+			}
+
+			_, err := auth.validateRequest(context.Background(), make(url.Values))
+			var unexpectedErr *UnexpectedResponseError
+			assert.True(t, errors.As(err, &unexpectedErr), err)
+			assert.Equal(t, tt.status, unexpectedErr.StatusCode)
+			assert.Equal(t, tt.body, unexpectedErr.Body)
+			assert.Contains(t, err.Error(), fmt.Sprint(tt.status))
+		})
+	}
+}
+
+func TestTokenResponse_TimeUntilExpiry(t *testing.T) {
+	// A skewed clock, the expiry is judged by it rather than the local clock.
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tokenResponseBody, _ := json.Marshal(TokenResponse{ExpiresIn: 3600})
+	mockedHTTPClient := new(MockedHTTPClient)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = mockedHTTPClient
+	auth.clock = func() time.Time { return now }
+	mockedHTTPClient.On("Do", validationEndpoint, mock.Anything).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		},
+		nil,
+	)
+
+	res, err := auth.ValidateRefreshToken("refresh-token")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), res.ExpiresAt)
+	assert.Equal(t, time.Hour, res.TimeUntilExpiry())
+
+	expired := TokenResponse{ExpiresAt: time.Now().Add(-time.Minute)}
+	assert.True(t, expired.TimeUntilExpiry() < 0)
+}
+
+func TestTokenResponse_JSON(t *testing.T) {
+	t.Run("from Apple", func(t *testing.T) {
+		now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		res := TokenResponse{Clock: func() time.Time { return now }}
+		err := json.Unmarshal([]byte(`{"access_token":"access-token","expires_in":3600,"id_token":"id-token","refresh_token":"refresh-token","token_type":"Bearer"}`), &res)
+		assert.NoError(t, err)
+		assert.Equal(t, "access-token", res.AccessToken)
+		assert.Equal(t, "Bearer", res.TokenType)
+		assert.Equal(t, now.Add(time.Hour), res.ExpiresAt)
+	})
+
+	t.Run("local clock", func(t *testing.T) {
+		before := time.Now()
+		var res TokenResponse
+		assert.NoError(t, json.Unmarshal([]byte(`{"access_token":"access-token","expires_in":3600}`), &res))
+		assert.False(t, res.ExpiresAt.Before(before.Add(time.Hour)), res.ExpiresAt)
+		assert.False(t, res.ExpiresAt.After(time.Now().Add(time.Hour)), res.ExpiresAt)
+	})
+
+	t.Run("from storage", func(t *testing.T) {
+		expiresAt := time.Unix(1600000000, 0)
+		stored, err := json.Marshal(TokenResponse{AccessToken: "access-token", ExpiresIn: 3600, ExpiresAt: expiresAt})
+		assert.NoError(t, err)
+		assert.Contains(t, string(stored), `"expires_at":1600000000`)
+
+		var res TokenResponse
+		assert.NoError(t, json.Unmarshal(stored, &res))
+		assert.Equal(t, "access-token", res.AccessToken)
+		assert.True(t, expiresAt.Equal(res.ExpiresAt), res.ExpiresAt)
+	})
+
+	t.Run("without expiry", func(t *testing.T) {
+		stored, err := json.Marshal(TokenResponse{RefreshToken: "refresh-token"})
+		assert.NoError(t, err)
+		assert.NotContains(t, string(stored), "expires_at")
+
+		var res TokenResponse
+		assert.NoError(t, json.Unmarshal(stored, &res))
+		assert.True(t, res.ExpiresAt.IsZero())
+	})
+}
+
+func TestExchange_ProtectedParams(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	mockedHTTPClient := new(MockedHTTPClient)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = mockedHTTPClient
+	mockedHTTPClient.On("Do", validationEndpoint, mock.MatchedBy(func(form url.Values) bool {
+		return len(form["client_id"]) == 1 && form.Get("client_id") == "appID" &&
+			len(form["client_secret"]) == 1 && form.Get("client_secret") != "caller-secret" &&
+			len(form["grant_type"]) == 1 && form.Get("grant_type") == GrantTypeAuthorizationCode &&
+			form.Get("code") == "code" &&
+			form.Get("future_param") == "value"
+	})).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		},
+		nil,
+	)
+
+	params := make(url.Values)
+	params.Add("code", "code")
+	params.Add("future_param", "value")
+	params.Add("client_id", "otherAppID")
+	params.Add("client_secret", "caller-secret")
+	params.Add("grant_type", GrantTypeRefreshToken)
+	_, err := auth.Exchange(context.Background(), GrantTypeAuthorizationCode, params)
+	assert.NoError(t, err)
+	mockedHTTPClient.AssertExpectations(t)
+	assert.Equal(t, "caller-secret", params.Get("client_secret"))
+}
+
+func TestWithMaxIdleConnsPerHost(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	assert.Equal(t, defaultMaxIdleConnsPerHost, auth.transport.MaxIdleConnsPerHost)
+	assert.Equal(t, auth.transport, auth.httpClient.(*http.Client).Transport)
+
+	auth = newAppleAuth("appID", "teamID", "keyID", nil, WithMaxIdleConnsPerHost(64))
+	assert.Equal(t, 64, auth.transport.MaxIdleConnsPerHost)
+	assert.NotEqual(t, 64, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost)
+}
+
+func TestWithTimeout(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	assert.Equal(t, defaultTimeout, auth.httpClient.(*http.Client).Timeout)
+	auth = newAppleAuth("appID", "teamID", "keyID", nil, WithTimeout(3*time.Second))
+	assert.Equal(t, 3*time.Second, auth.httpClient.(*http.Client).Timeout)
+}
+
+func TestValidateCode_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t),
+		WithTimeout(50*time.Millisecond), WithTokenEndpoint(server.URL))
+
+	start := time.Now()
+	_, err := auth.ValidateCode("code")
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	var proxied bool
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	client := &http.Client{
+		Timeout: time.Minute,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			proxied = true
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(tokenResponseBody))}, nil
+		}),
+	}
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t),
+		WithHTTPClient(client), WithTimeout(time.Second), WithMaxIdleConnsPerHost(64))
+
+	_, err := auth.ValidateCode("code")
+	assert.NoError(t, err)
+	assert.True(t, proxied)
+	assert.Equal(t, time.Minute, client.Timeout)
+	assert.Nil(t, auth.transport)
+}
+
+// Function adapter satisfying http.RoundTripper.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithTokenEndpoint(t *testing.T) {
+	var endpoint string
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t), WithTokenEndpoint("https://apple-proxy.internal/auth/token"))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		endpoint = req.URL.String()
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(tokenResponseBody))}, nil
+	})
+
+	_, err := auth.ValidateCode("code")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://apple-proxy.internal/auth/token", endpoint)
+}
+
+func TestNewWebConfig(t *testing.T) {
+	keyContent := newTestKeyContent(t)
+	auth, err := NewWebConfig("com.example.web", "teamID", "keyID", keyContent)
+	assert.NoError(t, err)
+	a := auth.(*appleAuth)
+	assert.Equal(t, "com.example.web", a.AppID)
+
+	clientSecret, err := a.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, validateClientSecret(clientSecret, "teamID", "com.example.web", time.Now()))
+
+	tests := []struct {
+		name                      string
+		servicesID, teamID, keyID string
+		key                       []byte
+	}{
+		{"missing services id", "", "teamID", "keyID", keyContent},
+		{"missing team id", "com.example.web", "", "keyID", keyContent},
+		{"missing key id", "com.example.web", "teamID", "", keyContent},
+		{"invalid key", "com.example.web", "teamID", "keyID", []byte("not a key")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewWebConfig(test.servicesID, test.teamID, test.keyID, test.key)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValidate_ComputesClientSecret(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	var clientSecrets []string
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		clientSecrets = append(clientSecrets, req.PostForm.Get("client_secret"))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	_, err := auth.ValidateCode("code")
+	assert.NoError(t, err)
+	_, err = auth.ValidateCodeWithRedirectURI("code", "https://saladeestar.app/apple")
+	assert.NoError(t, err)
+	_, err = auth.ValidateRefreshToken("refresh-token")
+	assert.NoError(t, err)
+
+	assert.Len(t, clientSecrets, 3)
+	for _, clientSecret := range clientSecrets {
+		assert.NoError(t, validateClientSecret(clientSecret, "teamID", "appID", time.Now()))
+	}
+}
+
+func TestExchangeWithClientID(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t), WithClientIDs("com.example.web"))
+	var form url.Values
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		form = req.PostForm
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	for _, clientID := range []string{"com.example.web", "appID"} {
+		_, err := auth.ExchangeWithClientID(context.Background(), clientID, GrantTypeAuthorizationCode, url.Values{"code": {"code"}})
+		assert.NoError(t, err)
+		assert.Equal(t, clientID, form.Get("client_id"))
+		assert.NoError(t, validateClientSecret(form.Get("client_secret"), "teamID", clientID, time.Now()))
+	}
+
+	form = nil
+	_, err := auth.ExchangeWithClientID(context.Background(), "com.example.other", GrantTypeAuthorizationCode, url.Values{"code": {"code"}})
+	assert.Equal(t, ErrUnknownClientID, err)
+	assert.Nil(t, form)
+}
+
+func TestNew_UnsupportedCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyContent := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	keyPath := filepath.Join(t.TempDir(), "key.p8")
+	if err := ioutil.WriteFile(keyPath, keyContent, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New("appID", "teamID", "keyID", keyPath)
+	assert.Equal(t, ErrUnsupportedCurve, err)
+	_, err = NewWebConfig("com.example.web", "teamID", "keyID", keyContent)
+	assert.Equal(t, ErrUnsupportedCurve, err)
+
+	keyPath = filepath.Join(t.TempDir(), "key.p8")
+	if err := ioutil.WriteFile(keyPath, newTestKeyContent(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New("appID", "teamID", "keyID", keyPath)
+	assert.NoError(t, err)
+}
+
+func TestNewFromKeyBytes(t *testing.T) {
+	auth, err := NewFromKeyBytes("appID", "teamID", "keyID", newTestKeyContent(t))
+	assert.NoError(t, err)
+	ttl, err := auth.ClientSecretTimeToLive()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+
+	_, err = NewFromKeyBytes("appID", "teamID", "keyID", []byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestNewWithPrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewWithPrivateKey("appID", "teamID", "keyID", key)
+	assert.NoError(t, err)
+	thumbprint, err := auth.KeyThumbprint()
+	assert.NoError(t, err)
+	expected, err := keyThumbprint(&key.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, thumbprint)
+
+	clientSecret, err := auth.(*appleAuth).clientSecret(context.Background())
+	assert.NoError(t, err)
+	_, err = jwt.Parse(clientSecret, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	assert.NoError(t, err)
+
+	otherCurve, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWithPrivateKey("appID", "teamID", "keyID", otherCurve)
+	assert.Equal(t, ErrUnsupportedCurve, err)
+	_, err = NewWithPrivateKey("appID", "teamID", "keyID", nil)
+	assert.Error(t, err)
+	_, err = NewWithPrivateKey("appID", "teamID", "", key)
+	assert.Equal(t, ErrKeyIDRequired, err)
+}
+
+func TestSetKey(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	thumbprint, err := auth.KeyThumbprint()
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrKeyIDRequired, auth.SetKey("", newTestKeyContent(t)))
+	assert.Error(t, auth.SetKey("newKeyID", []byte("not a key")))
+	current, err := auth.KeyThumbprint()
+	assert.NoError(t, err)
+	assert.Equal(t, thumbprint, current)
+
+	assert.NoError(t, auth.SetKey("newKeyID", newTestKeyContent(t)))
+	current, err = auth.KeyThumbprint()
+	assert.NoError(t, err)
+	assert.NotEqual(t, thumbprint, current)
+	clientSecret, err := auth.clientSecret(context.Background())
+	assert.NoError(t, err)
+	token, err := decodeJWT(clientSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, "newKeyID", token.header.KeyID)
+}
+
+func TestSetKey_Concurrent(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+	keys := [][]byte{newTestKeyContent(t), newTestKeyContent(t)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := auth.ValidateCode("code")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, auth.SetKey(fmt.Sprintf("keyID%d", i), keys[i%2]))
+	}
+	wg.Wait()
+}
+
+func TestRequestEncoding(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	var requests []*http.Request
+	var bodies []string
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		var body []byte
+		if req.Body != nil {
+			var err error
+			if body, err = ioutil.ReadAll(req.Body); err != nil {
+				return nil, err
+			}
+		}
+		requests = append(requests, req)
+		bodies = append(bodies, string(body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	_, err := auth.validateCodeWithRedirectURI(context.Background(), mockClientSecret, "a code/with+symbols", "https://saladeestar.app/apple?x=1")
+	assert.NoError(t, err)
+	_, _, _ = auth.fetchKeys(context.Background())
+
+	assert.Len(t, requests, 2)
+	token := requests[0]
+	assert.Equal(t, http.MethodPost, token.Method)
+	assert.Equal(t, validationEndpoint, token.URL.String())
+	assert.Equal(t, "application/x-www-form-urlencoded", token.Header.Get("Content-Type"))
+	assert.Equal(t, userAgent, token.Header.Get("User-Agent"))
+	assert.Equal(t, "client_id=appID&client_secret=client-secret&code=a+code%2Fwith%2Bsymbols&grant_type=authorization_code&redirect_uri=https%3A%2F%2Fsaladeestar.app%2Fapple%3Fx%3D1", bodies[0])
+	assert.Equal(t, int64(len(bodies[0])), token.ContentLength)
+
+	keys := requests[1]
+	assert.Equal(t, http.MethodGet, keys.Method)
+	assert.Equal(t, keysEndpoint, keys.URL.String())
+	assert.Empty(t, keys.Header.Get("Content-Type"))
+	assert.Equal(t, userAgent, keys.Header.Get("User-Agent"))
+	assert.Empty(t, bodies[1])
+}
+
+func TestRequestDecorator_OverridesUserAgent(t *testing.T) {
+	var userAgents []string
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t), WithRequestDecorator(func(req *http.Request) {
+		req.Header.Set("User-Agent", "my-service/1.0")
+	}))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		userAgents = append(userAgents, req.Header.Get("User-Agent"))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"id_token":"id-token","refresh_token":"refresh-token"}`))}, nil
+	})
+
+	_, err := auth.validateCode(context.Background(), mockClientSecret, "code")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"my-service/1.0"}, userAgents)
+}
+
+func TestValidateCode_RedirectURIMismatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		expectErr error
+	}{
+		{"redirect uri mismatch", `{"error":"invalid_grant","error_description":"Invalid redirect_uri"}`, ErrRedirectURIMismatch},
+		{"other grant failure", `{"error":"invalid_grant","error_description":"The code has expired or has been revoked."}`, ErrorResponseInvalidGrant},
+		{"no description", `{"error":"invalid_grant"}`, ErrorResponseInvalidGrant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(tt.body))),
+				}, nil
+			})
+
+			_, err := auth.ValidateCode("code")
+			assert.True(t, errors.Is(err, tt.expectErr), err)
+			assert.True(t, errors.Is(err, ErrorResponseInvalidGrant), err)
+			var errorResponse ErrorResponse
+			assert.True(t, errors.As(err, &errorResponse))
+			assert.Equal(t, http.StatusUnauthorized, errorResponse.HTTPStatus())
+		})
+	}
+}
+
+func TestValidateRequest_ResponseHeader(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(TokenResponse{AccessToken: "access-token", ExpiresIn: 3600, IDToken: "id-token", RefreshToken: "refresh-token"})
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Content-Type":         {"application/json"},
+				"Date":                 {"Mon, 02 Jan 2006 15:04:05 GMT"},
+				"X-Apple-Request-Uuid": {"request-uuid"},
+			},
+			Body: ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	res, err := auth.ValidateCode("code")
+	assert.NoError(t, err)
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", res.Header.Get("Date"))
+	assert.Equal(t, "request-uuid", res.Header.Get("X-Apple-Request-Uuid"))
+	body, _ := json.Marshal(res)
+	assert.NotContains(t, string(body), "request-uuid")
+}
+
+func TestValidateRequest_ExpiresAtFromDateHeader(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	appleTime := now.Add(-2 * time.Minute)
+	tokenResponseBody, _ := json.Marshal(TokenResponse{AccessToken: "access-token", ExpiresIn: 3600, IDToken: "id-token", RefreshToken: "refresh-token"})
+	tests := []struct {
+		name     string
+		date     string
+		expected time.Time
+	}{
+		{"date header", appleTime.Format(http.TimeFormat), appleTime.Add(time.Hour)},
+		{"no date header", "", now.Add(time.Hour)},
+		{"invalid date header", "yesterday", now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+			auth.clock = func() time.Time { return now }
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				header := http.Header{"Content-Type": {"application/json"}}
+				if tt.date != "" {
+					header.Set("Date", tt.date)
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+				}, nil
+			})
+
+			res, err := auth.ValidateCode("code")
+			assert.NoError(t, err)
+			assert.True(t, tt.expected.Equal(res.ExpiresAt), "expected %s, got %s", tt.expected, res.ExpiresAt)
+		})
+	}
+}
+
+func TestValidateRequest_NoExpiresIn(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(TokenResponse{IDToken: "id-token", RefreshToken: "refresh-token"})
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}, "Date": {time.Now().Format(http.TimeFormat)}},
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	res, err := auth.ValidateCode("code")
+	assert.NoError(t, err)
+	// As when decoding JSON without expiry, ExpiresAt is left unset.
+	assert.True(t, res.ExpiresAt.IsZero(), res.ExpiresAt)
+}
+
+func TestValidateRequest_IncompleteTokenResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		grantType string
+		response  TokenResponse
+		err       error
+	}{
+		{"code grant", GrantTypeAuthorizationCode, codeGrantResponse, nil},
+		{"code grant without id token", GrantTypeAuthorizationCode, TokenResponse{RefreshToken: "refresh-token"}, ErrIncompleteTokenResponse},
+		{"code grant without refresh token", GrantTypeAuthorizationCode, TokenResponse{IDToken: "id-token"}, ErrIncompleteTokenResponse},
+		{"refresh grant without id token", "refresh_token", TokenResponse{AccessToken: "access-token"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenResponseBody, _ := json.Marshal(tt.response)
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+				}, nil
+			})
+
+			form := url.Values{"grant_type": {tt.grantType}}
+			res, err := auth.validateRequest(context.Background(), form)
+			assert.Equal(t, tt.err, err)
+			if tt.err == nil {
+				assert.NotNil(t, res)
+			}
+		})
+	}
+}
+
+func TestValidateContext(t *testing.T) {
+	type contextKey struct{}
+	ctx := context.WithValue(context.Background(), contextKey{}, "inbound request")
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, "inbound request", req.Context().Value(contextKey{}))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	_, err := auth.ValidateCodeContext(ctx, "code")
+	assert.NoError(t, err)
+	_, err = auth.ValidateCodeWithRedirectURIContext(ctx, "code", "https://saladeestar.app/apple")
+	assert.NoError(t, err)
+	_, err = auth.ValidateRefreshTokenContext(ctx, "refresh-token")
+	assert.NoError(t, err)
+}
+
+func TestValidateContext_Canceled(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := auth.ValidateRefreshTokenContext(ctx, "refresh-token")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestValidateCode_FormValues(t *testing.T) {
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	var form url.Values
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if form, err = url.ParseQuery(string(body)); err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+		}, nil
+	})
+
+	assert.NotPanics(t, func() {
+		_, err := auth.ValidateCode("apple-authorization-code")
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, "appID", form.Get("client_id"))
+	assert.NotEmpty(t, form.Get("client_secret"))
+	assert.Equal(t, "apple-authorization-code", form.Get("code"))
+	assert.Equal(t, GrantTypeAuthorizationCode, form.Get("grant_type"))
+}
+
+func TestRevokeToken(t *testing.T) {
+	var req *http.Request
+	var form url.Values
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(r *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		req = r
+		if form, err = url.ParseQuery(string(body)); err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+	})
+
+	err := auth.RevokeToken(context.Background(), "refresh-token", TokenTypeHintRefreshToken)
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, revokeEndpoint, req.URL.String())
+	assert.Equal(t, "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+	assert.Equal(t, "appID", form.Get("client_id"))
+	assert.NotEmpty(t, form.Get("client_secret"))
+	assert.Equal(t, "refresh-token", form.Get("token"))
+	assert.Equal(t, TokenTypeHintRefreshToken, form.Get("token_type_hint"))
+}
+
+func TestRevokeToken_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"invalid request", `{"error":"invalid_request"}`, ErrorResponseInvalidRequest},
+		{"unauthorized client", `{"error":"unauthorized_client"}`, ErrorResponseUnauthorizedClient},
+		{"invalid client", `{"error":"invalid_client"}`, ErrorResponseInvalidClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+				}, nil
+			})
+
+			err := auth.RevokeToken(context.Background(), "access-token", TokenTypeHintAccessToken)
+			assert.True(t, errors.Is(err, tt.err), err)
+		})
+	}
+}
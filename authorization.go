@@ -0,0 +1,132 @@
+package apple
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const authorizationEndpoint = "https://appleid.apple.com/auth/authorize"
+
+// Response types supported by Apple authorize endpoint.
+const (
+	// ResponseTypeCode returns an authorization code.
+	ResponseTypeCode = "code"
+
+	// ResponseTypeCodeIDToken returns an authorization code and an id token.
+	ResponseTypeCodeIDToken = "code id_token"
+)
+
+// Response modes supported by Apple authorize endpoint.
+const (
+	// ResponseModeQuery sends the response in the query of the redirect uri.
+	ResponseModeQuery = "query"
+
+	// ResponseModeFragment sends the response in the fragment of the redirect
+	// uri.
+	ResponseModeFragment = "fragment"
+
+	// ResponseModeFormPost posts the response to the redirect uri as a form.
+	ResponseModeFormPost = "form_post"
+)
+
+// Scopes supported by Apple authorize endpoint.
+const (
+	// ScopeName requests the user name.
+	ScopeName = "name"
+
+	// ScopeEmail requests the user email.
+	ScopeEmail = "email"
+)
+
+// AuthorizationURLOptions the parameters of the authorization request. Apple
+// does not support the prompt parameter of OpenID Connect, the user is always
+// asked to sign in.
+type AuthorizationURLOptions struct {
+	// RedirectURI the uri Apple redirects the user to, required. It must be
+	// registered in the Apple Developer portal.
+	RedirectURI string
+
+	// ResponseType the response type, ResponseTypeCode when empty.
+	ResponseType string
+
+	// ResponseMode how the response is sent to the redirect uri. When empty,
+	// ResponseModeFormPost is used if scopes are requested,
+	// ResponseModeFragment with ResponseTypeCodeIDToken, otherwise Apple's
+	// default, ResponseModeQuery, applies. Apple requires ResponseModeFormPost
+	// when scopes are requested, and does not allow ResponseModeQuery with
+	// ResponseTypeCodeIDToken.
+	ResponseMode string
+
+	// Scopes the user information requested, ScopeName and ScopeEmail.
+	Scopes []string
+
+	// State an opaque value returned to the redirect uri, to prevent CSRF.
+	State string
+
+	// Nonce a value included in the id token, to prevent replay attacks.
+	Nonce string
+}
+
+// AuthorizationURL returns the url of Apple authorize endpoint to redirect the
+// user to, with the app id as client id. Combinations of options Apple
+// rejects return an error wrapping ErrInvalidAuthorizationOptions.
+func (a *appleAuth) AuthorizationURL(opts AuthorizationURLOptions) (string, error) {
+	if opts.RedirectURI == "" {
+		return "", fmt.Errorf("%w: redirect uri is required", ErrInvalidAuthorizationOptions)
+	}
+
+	responseType := opts.ResponseType
+	switch responseType {
+	case "":
+		responseType = ResponseTypeCode
+	case ResponseTypeCode, ResponseTypeCodeIDToken:
+	default:
+		return "", fmt.Errorf("%w: unsupported response type %q", ErrInvalidAuthorizationOptions, responseType)
+	}
+
+	for _, scope := range opts.Scopes {
+		if scope != ScopeName && scope != ScopeEmail {
+			return "", fmt.Errorf("%w: unsupported scope %q", ErrInvalidAuthorizationOptions, scope)
+		}
+	}
+
+	responseMode := opts.ResponseMode
+	switch responseMode {
+	case "":
+		switch {
+		case len(opts.Scopes) > 0:
+			responseMode = ResponseModeFormPost
+		case responseType == ResponseTypeCodeIDToken:
+			// Apple's default, query, is not allowed with an id token.
+			responseMode = ResponseModeFragment
+		}
+	case ResponseModeQuery, ResponseModeFragment, ResponseModeFormPost:
+	default:
+		return "", fmt.Errorf("%w: unsupported response mode %q", ErrInvalidAuthorizationOptions, responseMode)
+	}
+	if len(opts.Scopes) > 0 && responseMode != ResponseModeFormPost {
+		return "", fmt.Errorf("%w: response mode must be %s when scopes are requested", ErrInvalidAuthorizationOptions, ResponseModeFormPost)
+	}
+	if responseType == ResponseTypeCodeIDToken && responseMode == ResponseModeQuery {
+		return "", fmt.Errorf("%w: response mode %s is not allowed with response type %q", ErrInvalidAuthorizationOptions, ResponseModeQuery, responseType)
+	}
+
+	query := make(url.Values)
+	query.Set("client_id", a.AppID)
+	query.Set("redirect_uri", opts.RedirectURI)
+	query.Set("response_type", responseType)
+	if responseMode != "" {
+		query.Set("response_mode", responseMode)
+	}
+	if len(opts.Scopes) > 0 {
+		query.Set("scope", strings.Join(opts.Scopes, " "))
+	}
+	if opts.State != "" {
+		query.Set("state", opts.State)
+	}
+	if opts.Nonce != "" {
+		query.Set("nonce", opts.Nonce)
+	}
+	return authorizationEndpoint + "?" + query.Encode(), nil
+}
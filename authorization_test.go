@@ -0,0 +1,83 @@
+package apple
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationURL(t *testing.T) {
+	auth := newAppleAuth("com.example.web", "teamID", "keyID", nil)
+	tests := []struct {
+		name  string
+		opts  AuthorizationURLOptions
+		query url.Values
+	}{
+		{
+			"defaults",
+			AuthorizationURLOptions{RedirectURI: "https://example.com/apple"},
+			url.Values{"response_type": {"code"}},
+		},
+		{
+			"query",
+			AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseMode: ResponseModeQuery, State: "state"},
+			url.Values{"response_type": {"code"}, "response_mode": {"query"}, "state": {"state"}},
+		},
+		{
+			"fragment",
+			AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseType: ResponseTypeCodeIDToken, ResponseMode: ResponseModeFragment, Nonce: "nonce"},
+			url.Values{"response_type": {"code id_token"}, "response_mode": {"fragment"}, "nonce": {"nonce"}},
+		},
+		{
+			"id token defaults to fragment",
+			AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseType: ResponseTypeCodeIDToken},
+			url.Values{"response_type": {"code id_token"}, "response_mode": {"fragment"}},
+		},
+		{
+			"form post",
+			AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseMode: ResponseModeFormPost, Scopes: []string{ScopeName, ScopeEmail}},
+			url.Values{"response_type": {"code"}, "response_mode": {"form_post"}, "scope": {"name email"}},
+		},
+		{
+			"scopes default to form post",
+			AuthorizationURLOptions{RedirectURI: "https://example.com/apple", Scopes: []string{ScopeEmail}},
+			url.Values{"response_type": {"code"}, "response_mode": {"form_post"}, "scope": {"email"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authorizationURL, err := auth.AuthorizationURL(test.opts)
+			assert.NoError(t, err)
+			u, err := url.Parse(authorizationURL)
+			assert.NoError(t, err)
+			assert.Equal(t, authorizationEndpoint, u.Scheme+"://"+u.Host+u.Path)
+			test.query.Set("client_id", "com.example.web")
+			test.query.Set("redirect_uri", "https://example.com/apple")
+			assert.Equal(t, test.query, u.Query())
+		})
+	}
+}
+
+func TestAuthorizationURL_Invalid(t *testing.T) {
+	auth := newAppleAuth("com.example.web", "teamID", "keyID", nil)
+	tests := []struct {
+		name string
+		opts AuthorizationURLOptions
+	}{
+		{"missing redirect uri", AuthorizationURLOptions{}},
+		{"unsupported response type", AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseType: "token"}},
+		{"unsupported response mode", AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseMode: "web_message"}},
+		{"unsupported scope", AuthorizationURLOptions{RedirectURI: "https://example.com/apple", Scopes: []string{"openid"}}},
+		{"scopes with query", AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseMode: ResponseModeQuery, Scopes: []string{ScopeName}}},
+		{"scopes with fragment", AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseMode: ResponseModeFragment, Scopes: []string{ScopeName}}},
+		{"id token with query", AuthorizationURLOptions{RedirectURI: "https://example.com/apple", ResponseType: ResponseTypeCodeIDToken, ResponseMode: ResponseModeQuery}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := auth.AuthorizationURL(test.opts)
+			assert.True(t, errors.Is(err, ErrInvalidAuthorizationOptions), err)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package apple
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheKeyPrefix the prefix of the keys the package stores in the Cache.
+	cacheKeyPrefix = "apple-auth-go:"
+
+	// keysCacheKey the Cache key of the JSON Web Key Set served by Apple.
+	keysCacheKey = cacheKeyPrefix + "jwks"
+
+	// keysCacheTTL how long the key set is kept in the Cache. Unknown key ids
+	// are fetched from Apple regardless.
+	keysCacheTTL = time.Hour
+
+	// clientSecretRenewMargin how long before its expiration a cached client
+	// secret is replaced by a new one.
+	clientSecretRenewMargin = 24 * time.Hour
+)
+
+// Cache stores the values the package shares between instances: the key set
+// fetched from Apple and the signed client secrets. The default is in memory,
+// backing it with a shared store such as Redis lets a fleet fetch the keys and
+// sign the client secret once. Implementations must be safe for concurrent
+// use. Errors are logged and treated as cache misses, so an unavailable cache
+// only costs extra requests to Apple and extra signatures.
+type Cache interface {
+	// Get returns the value stored for the key and whether it was found.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+
+	// Set stores the value for the key for the given duration.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// NewMemoryCache returns an in memory Cache, the default one.
+func NewMemoryCache() Cache {
+	return &memoryCache{items: make(map[string]memoryCacheItem)}
+}
+
+// memoryCache is the in memory Cache.
+type memoryCache struct {
+	mu    sync.Mutex
+	items map[string]memoryCacheItem
+	now   func() time.Time
+}
+
+type memoryCacheItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !c.clock().Before(item.expiresAt) {
+		delete(c.items, key)
+		return nil, false, nil
+	}
+	return append([]byte(nil), item.value...), true, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock()
+	for k, item := range c.items {
+		if !now.Before(item.expiresAt) {
+			delete(c.items, k)
+		}
+	}
+	c.items[key] = memoryCacheItem{
+		value:     append([]byte(nil), value...),
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+func (c *memoryCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// cacheGet returns the value cached for the key. Cache errors are logged and
+// reported as misses.
+func (a *appleAuth) cacheGet(ctx context.Context, key string) ([]byte, bool) {
+	if a.cache == nil {
+		return nil, false
+	}
+	value, ok, err := a.cache.Get(ctx, key)
+	if err != nil {
+		a.log(LogLevelWarn, "cache get failed", map[string]interface{}{"error": err.Error()})
+		return nil, false
+	}
+	return value, ok
+}
+
+// cacheSet caches the value for the key. Cache errors are logged and ignored.
+func (a *appleAuth) cacheSet(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if a.cache == nil || ttl <= 0 {
+		return
+	}
+	if err := a.cache.Set(ctx, key, value, ttl); err != nil {
+		a.log(LogLevelWarn, "cache set failed", map[string]interface{}{"error": err.Error()})
+	}
+}
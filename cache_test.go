@@ -0,0 +1,188 @@
+package apple
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingCache is a Cache whose store is unavailable.
+type failingCache struct{}
+
+func (failingCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	return nil, false, errors.New("cache unavailable")
+}
+
+func (failingCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return errors.New("cache unavailable")
+}
+
+func TestMemoryCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cache := &memoryCache{items: make(map[string]memoryCacheItem), now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	_, ok, err := cache.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	value := []byte("value")
+	assert.NoError(t, cache.Set(ctx, "key", value, time.Minute))
+	value[0] = 'V'
+	cached, ok, err := cache.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), cached)
+
+	now = now.Add(time.Minute)
+	_, ok, _ = cache.Get(ctx, "key")
+	assert.False(t, ok)
+}
+
+func TestMemoryCache_Concurrent(t *testing.T) {
+	cache := NewMemoryCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = cache.Set(context.Background(), "key", []byte("value"), time.Minute)
+				_, _, _ = cache.Get(context.Background(), "key")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWithCache_Shared(t *testing.T) {
+	key := newTestRSAKey(t)
+	apple := newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), nil)
+	fetches := 0
+	keyContent := newTestKeyContent(t)
+	cache := NewMemoryCache()
+	newInstance := func() *appleAuth {
+		auth := newAppleAuth("appID", "teamID", "keyID", keyContent, WithCache(cache))
+		auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			fetches++
+			return apple.Do(req)
+		})
+		return auth
+	}
+	first, second := newInstance(), newInstance()
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+
+	_, err := first.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	_, err = second.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	hook := &testMetricsHook{}
+	first.metrics, second.metrics = hook, hook
+	firstSecret, err := first.clientSecret(context.Background())
+	assert.NoError(t, err)
+	secondSecret, err := second.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, firstSecret, secondSecret)
+	assert.Equal(t, 1, hook.clientSecrets)
+
+	// A new key signs a new client secret.
+	assert.NoError(t, second.SetKey("keyID", newTestKeyContent(t)))
+	rotatedSecret, err := second.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.NotEqual(t, firstSecret, rotatedSecret)
+}
+
+func TestWithCache_SharedKeysMaxAge(t *testing.T) {
+	key := newTestRSAKey(t)
+	apple := newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), nil)
+	fetches := 0
+	now := time.Now()
+	cache := NewMemoryCache()
+	newInstance := func() *appleAuth {
+		auth := newAppleAuth("appID", "teamID", "keyID", nil, WithCache(cache))
+		auth.clock = func() time.Time { return now }
+		auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			fetches++
+			res, err := apple.Do(req)
+			if err == nil {
+				res.Header = http.Header{"Cache-Control": {"max-age=60"}}
+			}
+			return res, err
+		})
+		return auth
+	}
+	first, second := newInstance(), newInstance()
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+
+	_, err := first.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = second.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// The key set read from the shared cache expires with the max age of the
+	// fetch that stored it, not keysCacheTTL.
+	now = now.Add(31 * time.Second)
+	_, err = second.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+// contextCache is a Cache that records the contexts it is called with.
+type contextCache struct {
+	Cache
+	contexts []context.Context
+}
+
+func (c *contextCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.contexts = append(c.contexts, ctx)
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *contextCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.contexts = append(c.contexts, ctx)
+	return c.Cache.Set(ctx, key, value, ttl)
+}
+
+func TestWithCache_ClientSecretContext(t *testing.T) {
+	type ctxKey struct{}
+	cache := &contextCache{Cache: NewMemoryCache()}
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t), WithCache(cache))
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	_, err := auth.clientSecret(ctx)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cache.contexts)
+	for _, got := range cache.contexts {
+		assert.Equal(t, "request", got.Value(ctxKey{}))
+	}
+}
+
+func TestWithCache_Failing(t *testing.T) {
+	key := newTestRSAKey(t)
+	var logged []string
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t),
+		WithCache(failingCache{}),
+		WithLogger(LoggerFunc(func(level LogLevel, msg string, fields map[string]interface{}) {
+			logged = append(logged, msg)
+		}), LogLevelWarn),
+	)
+	auth.httpClient = newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), nil)
+
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+	_, err := auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	_, err = auth.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, logged, "cache get failed")
+	assert.Contains(t, logged, "cache set failed")
+}
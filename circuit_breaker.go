@@ -0,0 +1,104 @@
+package apple
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerCooldown         = 30 * time.Second
+)
+
+// CircuitBreakerOptions configures the circuit breaker around the requests to
+// Apple servers.
+type CircuitBreakerOptions struct {
+	// FailureThreshold the number of consecutive failures, network errors or
+	// 5xx responses, that opens the circuit. Defaults to 5.
+	FailureThreshold int
+
+	// Cooldown how long the circuit stays open, failing fast with
+	// ErrCircuitOpen, before a trial request is let through. Defaults to 30
+	// seconds.
+	Cooldown time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// requestOutcome the outcome of a request as seen by the circuit breaker.
+type requestOutcome int
+
+const (
+	// outcomeSuccess Apple answered, even with a 4xx business error.
+	outcomeSuccess requestOutcome = iota
+	// outcomeFailure the request failed with a network error or a 5xx response.
+	outcomeFailure
+	// outcomeIgnored the request was canceled by the caller, which says
+	// nothing about Apple's health.
+	outcomeIgnored
+)
+
+// circuitBreaker fails fast while Apple servers are failing.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	opts     CircuitBreakerOptions
+	now      func() time.Time
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions, now func() time.Time) *circuitBreaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultCircuitBreakerFailureThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{opts: opts, now: now}
+}
+
+// allow returns ErrCircuitOpen when the request must not be sent. Once the
+// cooldown elapses a single trial request is allowed, half-opening the circuit.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.opts.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = circuitHalfOpen
+	case circuitHalfOpen:
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// done records the outcome of an allowed request.
+func (b *circuitBreaker) done(outcome requestOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch outcome {
+	case outcomeSuccess:
+		b.state = circuitClosed
+		b.failures = 0
+	case outcomeFailure:
+		b.failures++
+		if b.state == circuitHalfOpen || b.failures >= b.opts.FailureThreshold {
+			b.state = circuitOpen
+			b.openedAt = b.now()
+		}
+	case outcomeIgnored:
+		if b.state == circuitHalfOpen {
+			// Let the next request be the trial without waiting another cooldown.
+			b.state = circuitOpen
+		}
+	}
+}
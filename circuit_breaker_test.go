@@ -0,0 +1,95 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Apple server double whose answer is changed by the test, counting the requests it receives.
+type scriptedAppleServer struct {
+	status   int
+	body     string
+	err      error
+	requests int
+}
+
+func (s *scriptedAppleServer) Do(req *http.Request) (*http.Response, error) {
+	s.requests++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(s.body))),
+	}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	server := &scriptedAppleServer{status: http.StatusServiceUnavailable}
+	auth := &appleAuth{httpClient: server, clock: func() time.Time { return now }}
+	WithCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 3, Cooldown: time.Minute})(auth)
+	request := func() error {
+		_, err := auth.validateRequest(context.Background(), make(url.Values))
+		return err
+	}
+
+	// Closed: failures are let through until the threshold is reached.
+	for i := 0; i < 3; i++ {
+		assert.False(t, errors.Is(request(), ErrCircuitOpen))
+	}
+	assert.Equal(t, 3, server.requests)
+
+	// Open: requests fail fast without reaching Apple.
+	assert.True(t, errors.Is(request(), ErrCircuitOpen))
+	now = now.Add(59 * time.Second)
+	assert.True(t, errors.Is(request(), ErrCircuitOpen))
+	assert.Equal(t, 3, server.requests)
+
+	// Half-open: after the cooldown a failing trial request opens the circuit again.
+	now = now.Add(time.Second)
+	server.status, server.err = 0, assert.AnError
+	assert.True(t, errors.Is(request(), assert.AnError))
+	assert.True(t, errors.Is(request(), ErrCircuitOpen))
+	assert.Equal(t, 4, server.requests)
+
+	// Half-open: a successful trial request closes the circuit.
+	now = now.Add(time.Minute)
+	server.status, server.err, server.body = http.StatusOK, nil, `{}`
+	assert.NoError(t, request())
+	assert.NoError(t, request())
+	assert.Equal(t, 6, server.requests)
+}
+
+func TestCircuitBreaker_BusinessErrorsAreNotFailures(t *testing.T) {
+	server := &scriptedAppleServer{status: http.StatusBadRequest, body: `{"error":"invalid_grant"}`}
+	auth := &appleAuth{httpClient: server}
+	WithCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 2})(auth)
+
+	for i := 0; i < 5; i++ {
+		_, err := auth.validateRequest(context.Background(), make(url.Values))
+		assert.Equal(t, ErrorResponseInvalidGrant, err)
+	}
+	assert.Equal(t, 5, server.requests)
+}
+
+func TestCircuitBreaker_CanceledRequestsAreNotFailures(t *testing.T) {
+	server := &scriptedAppleServer{err: context.Canceled}
+	auth := &appleAuth{httpClient: server}
+	WithCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1})(auth)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		_, err := auth.validateRequest(ctx, make(url.Values))
+		assert.NotEqual(t, ErrCircuitOpen, err)
+	}
+}
@@ -0,0 +1,107 @@
+package apple
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultClientSecretLifetime the default lifetime of the generated client
+	// secrets, just under the maximum Apple accepts.
+	defaultClientSecretLifetime = 15776999 * time.Second
+
+	// maxClientSecretLifetime the maximum lifetime of a client secret accepted
+	// by Apple, 6 months.
+	maxClientSecretLifetime = 15777000 * time.Second
+)
+
+// validateClientSecret checks the client secret meets Apple's requirements: an
+// ES256 header with a key id and the claims iss, sub and aud set to the team
+// id, the app id and Apple, issued no later than now and expiring within 6
+// months. Violations are returned wrapping ErrInvalidClientSecret. The
+// signature is not verified.
+func validateClientSecret(clientSecret, teamID, appID string, now time.Time) error {
+	token, err := decodeJWT(clientSecret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidClientSecret, err)
+	}
+	if token.header.Algorithm != "ES256" {
+		return fmt.Errorf("%w: alg is %q, want ES256", ErrInvalidClientSecret, token.header.Algorithm)
+	}
+	if token.header.KeyID == "" {
+		return fmt.Errorf("%w: missing kid", ErrInvalidClientSecret)
+	}
+
+	if iss, _ := token.claims["iss"].(string); iss != teamID {
+		return fmt.Errorf("%w: iss is %q, want the team id %q", ErrInvalidClientSecret, iss, teamID)
+	}
+	if sub, _ := token.claims["sub"].(string); sub != appID {
+		return fmt.Errorf("%w: sub is %q, want the app id %q", ErrInvalidClientSecret, sub, appID)
+	}
+	if !hasAudience(token.claims, appleAudience) {
+		return fmt.Errorf("%w: aud is %v, want %q", ErrInvalidClientSecret, token.claims["aud"], appleAudience)
+	}
+
+	iat, ok := numberClaim(token.claims, "iat")
+	if !ok {
+		return fmt.Errorf("%w: missing iat", ErrInvalidClientSecret)
+	}
+	exp, ok := numberClaim(token.claims, "exp")
+	if !ok {
+		return fmt.Errorf("%w: missing exp", ErrInvalidClientSecret)
+	}
+	if time.Unix(iat, 0).After(now) {
+		return fmt.Errorf("%w: iat is in the future", ErrInvalidClientSecret)
+	}
+	if lifetime := time.Duration(exp-iat) * time.Second; lifetime > maxClientSecretLifetime {
+		return fmt.Errorf("%w: lifetime of %s exceeds 6 months", ErrInvalidClientSecret, lifetime)
+	}
+	return nil
+}
+
+// clientSecretExpired reports whether the exp claim of the client secret is
+// past. Client secrets that can't be decoded are left for Apple to judge.
+func (a *appleAuth) clientSecretExpired(clientSecret string) bool {
+	timeLeft, ok := a.clientSecretTimeLeft(clientSecret)
+	return ok && timeLeft <= 0
+}
+
+// clientSecretTimeLeft returns how long until the exp claim of the client
+// secret, and false when it can't be decoded or has no exp claim.
+func (a *appleAuth) clientSecretTimeLeft(clientSecret string) (time.Duration, bool) {
+	token, err := decodeJWT(clientSecret)
+	if err != nil {
+		return 0, false
+	}
+	exp, ok := numberClaim(token.claims, "exp")
+	if !ok {
+		return 0, false
+	}
+	return time.Unix(exp, 0).Sub(a.now()), true
+}
+
+// ClientSecretTimeToLive returns how long the client secret sent to Apple
+// remains valid, from its exp claim and the clock, for diagnostics endpoints
+// and admin dashboards. It fails when no valid key is configured.
+func (a *appleAuth) ClientSecretTimeToLive() (time.Duration, error) {
+	clientSecret, err := a.clientSecret(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	timeLeft, ok := a.clientSecretTimeLeft(clientSecret)
+	if !ok {
+		return 0, fmt.Errorf("%w: missing exp", ErrInvalidClientSecret)
+	}
+	return timeLeft, nil
+}
+
+// clientSecretRenewWindow returns how long before its expiration a cached
+// client secret is replaced by a new one: clientSecretRenewMargin, or half the
+// lifetime of short lived client secrets.
+func (a *appleAuth) clientSecretRenewWindow() time.Duration {
+	if half := a.clientSecretLifetime / 2; half < clientSecretRenewMargin {
+		return half
+	}
+	return clientSecretRenewMargin
+}
@@ -0,0 +1,211 @@
+package apple
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Re-encodes the client secret applying the given mutation to its decoded
+// header and claims. The signature is kept as is.
+func mutateClientSecret(t *testing.T, clientSecret string, mutate func(header, claims map[string]interface{})) string {
+	segments := strings.Split(clientSecret, ".")
+	var header, claims map[string]interface{}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		raw, err := base64.RawURLEncoding.DecodeString(segments[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mutate(header, claims)
+	headerBytes, _ := json.Marshal(header)
+	claimsBytes, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes) + "." + segments[2]
+}
+
+func TestValidateClientSecret(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	clientSecret, err := auth.clientSecret(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	assert.NoError(t, validateClientSecret(clientSecret, "teamID", "appID", now))
+
+	tests := []struct {
+		name   string
+		mutate func(header, claims map[string]interface{})
+	}{
+		{"alg", func(header, claims map[string]interface{}) { header["alg"] = "RS256" }},
+		{"kid", func(header, claims map[string]interface{}) { delete(header, "kid") }},
+		{"iss", func(header, claims map[string]interface{}) { claims["iss"] = "otherTeamID" }},
+		{"sub", func(header, claims map[string]interface{}) { claims["sub"] = "otherAppID" }},
+		{"aud", func(header, claims map[string]interface{}) { claims["aud"] = "https://example.com" }},
+		{"missing iat", func(header, claims map[string]interface{}) { delete(claims, "iat") }},
+		{"missing exp", func(header, claims map[string]interface{}) { delete(claims, "exp") }},
+		{"iat in the future", func(header, claims map[string]interface{}) {
+			claims["iat"] = now.Add(time.Minute).Unix()
+		}},
+		{"lifetime", func(header, claims map[string]interface{}) {
+			claims["exp"] = now.Add(maxClientSecretLifetime + time.Second).Unix()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateClientSecret(mutateClientSecret(t, clientSecret, test.mutate), "teamID", "appID", now)
+			assert.True(t, errors.Is(err, ErrInvalidClientSecret), err)
+		})
+	}
+
+	err = validateClientSecret("not-a-jwt", "teamID", "appID", now)
+	assert.True(t, errors.Is(err, ErrInvalidClientSecret), err)
+}
+
+func TestClientSecretExpired(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = mockedHTTPClient
+	clientSecret, err := auth.clientSecret(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Add(defaultClientSecretLifetime + time.Second)
+	auth.clock = func() time.Time { return now }
+	_, err = auth.validateCode(context.Background(), clientSecret, "code")
+	assert.Equal(t, ErrClientSecretExpired, err)
+	mockedHTTPClient.AssertNotCalled(t, "Do", mock.Anything, mock.Anything)
+
+	// Secrets generated with the same clock are fresh.
+	clientSecret, err = auth.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, auth.clientSecretExpired(clientSecret))
+	assert.False(t, auth.clientSecretExpired(mockClientSecret))
+}
+
+func TestExchange_InvalidClient(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name      string
+		elapsed   time.Duration
+		expectErr error
+		hint      string
+	}{
+		{"expired client secret", defaultClientSecretLifetime + time.Second, ErrClientSecretExpired, "regenerate the client secret"},
+		{"valid client secret", time.Second, ErrorResponseInvalidClient, "more than 6 months ago"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := now
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+			auth.clock = func() time.Time { return clock }
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				// The client secret expires while the request is in flight.
+				clock = clock.Add(tt.elapsed)
+				return &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(`{"error":"invalid_client"}`)),
+				}, nil
+			})
+
+			_, err := auth.ValidateRefreshToken("refresh-token")
+			assert.True(t, errors.Is(err, tt.expectErr), err)
+			assert.Contains(t, err.Error(), tt.hint)
+		})
+	}
+}
+
+func TestClientSecretTimeToLive(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.clock = func() time.Time { return now }
+
+	ttl, err := auth.ClientSecretTimeToLive()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultClientSecretLifetime, ttl)
+
+	_, err = newAppleAuth("appID", "teamID", "", newTestKeyContent(t)).ClientSecretTimeToLive()
+	assert.Equal(t, ErrKeyIDRequired, err)
+	_, err = newAppleAuth("appID", "teamID", "keyID", nil).ClientSecretTimeToLive()
+	assert.Error(t, err)
+}
+
+func TestClientSecret_RoundTrip(t *testing.T) {
+	keyContent := newTestKeyContent(t)
+	privateKey, err := parsePrivateKey(keyContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newAppleAuth("appID", "teamID", "keyID", keyContent)
+	clientSecret, err := auth.clientSecret(context.Background())
+	assert.NoError(t, err)
+
+	var claims jwt.StandardClaims
+	token, err := jwt.ParseWithClaims(clientSecret, &claims, func(token *jwt.Token) (interface{}, error) {
+		return &privateKey.PublicKey, nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+	assert.Equal(t, jwt.SigningMethodES256, token.Method)
+	assert.Equal(t, "ES256", token.Header["alg"])
+	assert.Equal(t, "keyID", token.Header["kid"])
+	assert.Equal(t, "teamID", claims.Issuer)
+	assert.Equal(t, "appID", claims.Subject)
+	assert.Equal(t, appleAudience, claims.Audience)
+	assert.False(t, time.Unix(claims.IssuedAt, 0).After(time.Now()))
+	assert.LessOrEqual(t, time.Duration(claims.ExpiresAt-claims.IssuedAt)*time.Second, maxClientSecretLifetime)
+
+	otherKey, err := parsePrivateKey(newTestKeyContent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jwt.Parse(clientSecret, func(token *jwt.Token) (interface{}, error) {
+		return &otherKey.PublicKey, nil
+	})
+	assert.Error(t, err)
+}
+
+func TestWithClientSecretTTL(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	auth, err := NewFromKeyBytes("appID", "teamID", "keyID", newTestKeyContent(t), WithClientSecretTTL(time.Hour))
+	assert.NoError(t, err)
+	a := auth.(*appleAuth)
+	a.clock = func() time.Time { return now }
+
+	clientSecret, err := a.clientSecret(context.Background())
+	assert.NoError(t, err)
+	token, err := decodeJWT(clientSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(now.Add(time.Hour).Unix()), token.claims["exp"])
+
+	// Short lived client secrets are reused until half their lifetime.
+	now = now.Add(29 * time.Minute)
+	reused, err := a.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, clientSecret, reused)
+	now = now.Add(2 * time.Minute)
+	renewed, err := a.clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.NotEqual(t, clientSecret, renewed)
+
+	for _, ttl := range []time.Duration{0, -time.Hour, maxClientSecretLifetime + time.Second} {
+		_, err := NewFromKeyBytes("appID", "teamID", "keyID", newTestKeyContent(t), WithClientSecretTTL(ttl))
+		assert.True(t, errors.Is(err, ErrInvalidClientSecretTTL), ttl)
+	}
+	_, err = NewFromKeyBytes("appID", "teamID", "keyID", newTestKeyContent(t), WithClientSecretTTL(maxClientSecretLifetime))
+	assert.NoError(t, err)
+}
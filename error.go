@@ -1,6 +1,10 @@
 package apple
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
 
 var (
 	// ErrorResponseTypeInvalidRequest the request is malformed, typically
@@ -74,9 +78,235 @@ type ErrorResponseType string
 type ErrorResponse struct {
 	Type    ErrorResponseType
 	Message string
+
+	// Description the error_description Apple sent along with the error, such
+	// as the parameter that was invalid. It is empty when Apple sent none.
+	Description string
 }
 
 // Error implements the error interface.
 func (e ErrorResponse) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.Type, e.Message, e.Description)
+	}
 	return fmt.Sprintf("%s: %s", e.Type, e.Message)
 }
+
+// Is reports whether target is an ErrorResponse of the same type, so errors
+// returned with a description still match the ErrorResponse variables with
+// errors.Is.
+func (e ErrorResponse) Is(target error) bool {
+	t, ok := target.(ErrorResponse)
+	return ok && t.Type == e.Type
+}
+
+// withDescription returns a copy of the error with the description Apple sent.
+func (e ErrorResponse) withDescription(description string) ErrorResponse {
+	e.Description = description
+	return e
+}
+
+// redirectURIMismatchError is the invalid_grant error Apple answers when the
+// redirect uri does not match. It matches both ErrRedirectURIMismatch and
+// ErrorResponseInvalidGrant with errors.Is, and unwraps to the ErrorResponse.
+type redirectURIMismatchError struct {
+	response ErrorResponse
+}
+
+// Error implements the error interface.
+func (e redirectURIMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRedirectURIMismatch, e.response.Description)
+}
+
+// Is reports whether target is ErrRedirectURIMismatch.
+func (e redirectURIMismatchError) Is(target error) bool {
+	return target == ErrRedirectURIMismatch
+}
+
+// Unwrap returns the ErrorResponse Apple answered with.
+func (e redirectURIMismatchError) Unwrap() error {
+	return e.response
+}
+
+// HTTPStatus returns the HTTP status an API server can answer its own clients
+// with when an Apple request fails with this error.
+func (e ErrorResponse) HTTPStatus() int {
+	switch e.Type {
+	case ErrorResponseTypeInvalidRequest, ErrorResponseTypeUnsupportedGrantType, ErrorResponseTypeInvalidScope:
+		return http.StatusBadRequest
+	case ErrorResponseTypeInvalidClient, ErrorResponseTypeInvalidGrant:
+		return http.StatusUnauthorized
+	case ErrorResponseTypeUnauthorizedClient:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+var (
+	// ErrCircuitOpen requests to Apple are not sent because they have been
+	// failing consecutively. See WithCircuitBreaker.
+	ErrCircuitOpen = errors.New("circuit breaker is open, Apple requests are failing")
+
+	// ErrClosed the AppleAuth was closed with Close.
+	ErrClosed = errors.New("apple auth is closed")
+
+	// ErrKeyIDRequired the key id is required to sign the client secret.
+	ErrKeyIDRequired = errors.New("key id is required to sign the client secret")
+
+	// ErrUnsupportedCurve the private key is not on the P-256 curve, the only
+	// one Apple accepts for client secrets signed with ES256.
+	ErrUnsupportedCurve = errors.New("private key curve is not P-256")
+
+	// ErrUnknownClientID the client id is neither the app id nor one of the
+	// client ids added with WithClientIDs.
+	ErrUnknownClientID = errors.New("unknown client id")
+
+	// ErrIncompleteTokenResponse Apple answered an authorization code grant
+	// successfully but without an id token or refresh token.
+	ErrIncompleteTokenResponse = errors.New("incomplete token response")
+
+	// ErrInvalidClientSecretTTL the client secret ttl set with
+	// WithClientSecretTTL is not positive or exceeds the 6 months Apple accepts.
+	ErrInvalidClientSecretTTL = errors.New("invalid client secret ttl")
+
+	// ErrClientSecretExpired the client secret expired, so it is not sent to
+	// Apple which would answer invalid_client.
+	ErrClientSecretExpired = errors.New("client secret expired")
+
+	// ErrInvalidClientSecret the client secret does not meet Apple's
+	// requirements. The error wrapping it describes the violation.
+	ErrInvalidClientSecret = errors.New("invalid client secret")
+
+	// ErrInvalidAuthorizationOptions the authorization url options are
+	// invalid or combined in a way Apple rejects.
+	ErrInvalidAuthorizationOptions = errors.New("invalid authorization url options")
+
+	// ErrRedirectURIMismatch Apple rejected the authorization code because
+	// the redirect uri is missing, unexpected or differs from the one of the
+	// authorization request. Use ValidateCodeWithRedirectURI with the redirect
+	// uri of the authorization request, or ValidateCode when there was none.
+	ErrRedirectURIMismatch = errors.New("redirect uri does not match the authorization request")
+
+	// ErrMalformedIDToken the id token is not a well formed JSON Web Token.
+	ErrMalformedIDToken = errors.New("malformed id token")
+
+	// ErrInvalidSignature the id token signature does not match Apple's public key.
+	ErrInvalidSignature = errors.New("invalid id token signature")
+
+	// ErrUnsupportedAlgorithm the id token is signed with an algorithm that
+	// is not accepted.
+	ErrUnsupportedAlgorithm = errors.New("unsupported id token signing algorithm")
+
+	// ErrKeyNotFound no Apple public key matches the key id of the id token.
+	ErrKeyNotFound = errors.New("no Apple public key found for the id token key id")
+
+	// ErrNoMatchingKey the id token has no key id and no Apple public key
+	// verifies its signature.
+	ErrNoMatchingKey = errors.New("no Apple public key verifies the id token signature")
+
+	// ErrMissingKeyID the id token has no key id and none of the Apple public
+	// keys of its algorithm verifies its signature, so the key it claims to be
+	// signed with can't be told. It wraps ErrNoMatchingKey.
+	ErrMissingKeyID = fmt.Errorf("%w: id token has no key id", ErrNoMatchingKey)
+
+	// ErrInvalidIssuer the id token was not issued by Apple.
+	ErrInvalidIssuer = errors.New("invalid id token issuer")
+
+	// ErrInvalidAudience the id token was not issued for the configured app.
+	ErrInvalidAudience = errors.New("invalid id token audience")
+
+	// ErrInvalidAuthorizationHeader the Authorization header value is empty or
+	// not of the Bearer scheme.
+	ErrInvalidAuthorizationHeader = errors.New("invalid authorization header")
+
+	// ErrInvalidAuthorizedParty the id token has an azp claim which is
+	// neither the app id nor one of the client ids added with WithClientIDs.
+	ErrInvalidAuthorizedParty = errors.New("invalid id token authorized party")
+
+	// ErrInvalidSubject the sub claim of the id token does not have the format
+	// of Apple user identifiers. See WithValidateSubjectFormat.
+	ErrInvalidSubject = errors.New("invalid id token subject")
+
+	// ErrEmailDomainNotAllowed the email of the id token is not in one of the
+	// allowed domains. See WithAllowedEmailDomains.
+	ErrEmailDomainNotAllowed = errors.New("email domain not allowed")
+
+	// ErrRealUserStatusTooLow the real_user_status claim of the id token is
+	// below the minimum. See WithMinRealUserStatus.
+	ErrRealUserStatusTooLow = errors.New("id token real user status is too low")
+
+	// ErrTokenExpired the id token is expired.
+	ErrTokenExpired = errors.New("id token is expired")
+
+	// ErrTokenTooOld the id token was issued longer ago than the configured
+	// maximum token age.
+	ErrTokenTooOld = errors.New("id token is too old")
+
+	// ErrNonceMissing a nonce was expected but the id token has none.
+	ErrNonceMissing = errors.New("id token nonce is missing")
+
+	// ErrNonceMismatch the id token nonce differs from the expected nonce.
+	ErrNonceMismatch = errors.New("id token nonce does not match")
+
+	// ErrInvalidCodeHash the id token c_hash claim is missing or does not
+	// match the authorization code.
+	ErrInvalidCodeHash = errors.New("id token c_hash is missing or does not match the authorization code")
+
+	// ErrInvalidAccessTokenHash the id token at_hash claim is missing or does
+	// not match the access token.
+	ErrInvalidAccessTokenHash = errors.New("id token at_hash is missing or does not match the access token")
+)
+
+// PartialExchangeError is returned when the token exchange with Apple succeeded
+// but the verification of the returned id token failed. The tokens returned by
+// Apple are still valid and available in TokenResponse.
+type PartialExchangeError struct {
+	TokenResponse *TokenResponse
+	Err           error
+}
+
+// Error implements the error interface.
+func (e *PartialExchangeError) Error() string {
+	return fmt.Sprintf("id token verification failed after successful exchange: %v", e.Err)
+}
+
+// Unwrap returns the id token verification error.
+func (e *PartialExchangeError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// maxErrorBodySize the maximum size of an error response body read.
+	maxErrorBodySize = 64 << 10
+
+	// maxErrorBodySnippetSize the maximum size of the body kept in an
+	// UnexpectedResponseError.
+	maxErrorBodySnippetSize = 512
+)
+
+// UnexpectedResponseError is returned when Apple answers with a response that
+// is not a documented error, such as an HTML page during an outage or an
+// unknown error code. Its status code tells a client error from a server one,
+// for instance to decide whether to retry.
+type UnexpectedResponseError struct {
+	// StatusCode the HTTP status code of the response.
+	StatusCode int
+	// Body the beginning of the response body.
+	Body string
+}
+
+func newUnexpectedResponseError(statusCode int, body []byte) *UnexpectedResponseError {
+	if len(body) > maxErrorBodySnippetSize {
+		body = append(body[:maxErrorBodySnippetSize:maxErrorBodySnippetSize], "..."...)
+	}
+	return &UnexpectedResponseError{
+		StatusCode: statusCode,
+		Body:       string(body),
+	}
+}
+
+// Error implements the error interface.
+func (e *UnexpectedResponseError) Error() string {
+	return fmt.Sprintf("unexpected response with status %d: %s", e.StatusCode, e.Body)
+}
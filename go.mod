@@ -5,6 +5,4 @@ go 1.15
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/stretchr/testify v1.7.0
-	github.com/tideland/golib v4.24.2+incompatible // indirect
-	github.com/tideland/gorest v2.15.5+incompatible
 )
@@ -0,0 +1,157 @@
+package apple
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// jwtHeader is the JOSE header of a JSON Web Token.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtToken is a JSON Web Token in compact serialization decoded into its parts.
+// Its signature is not verified by decoding.
+type jwtToken struct {
+	header       jwtHeader
+	payload      []byte
+	claims       map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+// decodeJWT splits and decodes a JSON Web Token without verifying its signature.
+func decodeJWT(token string) (*jwtToken, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 segments, got %d", ErrMalformedIDToken, len(segments))
+	}
+
+	headerBytes, err := decodeSegment(segments[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding header: %v", ErrMalformedIDToken, err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("%w: decoding header: %v", ErrMalformedIDToken, err)
+	}
+
+	payload, err := decodeSegment(segments[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %v", ErrMalformedIDToken, err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %v", ErrMalformedIDToken, err)
+	}
+	if claims == nil {
+		return nil, fmt.Errorf("%w: payload is not a JSON object", ErrMalformedIDToken)
+	}
+
+	signature, err := decodeSegment(segments[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding signature: %v", ErrMalformedIDToken, err)
+	}
+
+	return &jwtToken{
+		header:       header,
+		payload:      payload,
+		claims:       claims,
+		signingInput: segments[0] + "." + segments[1],
+		signature:    signature,
+	}, nil
+}
+
+// segmentReplacer maps the standard base64 alphabet to the base64url one.
+var segmentReplacer = strings.NewReplacer("+", "-", "/", "_")
+
+// decodeSegment decodes a base64url encoded token segment. Some clients encode
+// tokens with the standard base64 alphabet or with padding, so both alphabets
+// are accepted and padding is ignored. Any other character is rejected.
+func decodeSegment(segment string) ([]byte, error) {
+	segment = segmentReplacer.Replace(strings.TrimRight(segment, "="))
+	return base64.RawURLEncoding.Strict().DecodeString(segment)
+}
+
+// jwkKey is a public key published in a JSON Web Key Set along with the
+// algorithm declared for it.
+type jwkKey struct {
+	key       crypto.PublicKey
+	algorithm string
+}
+
+// Equal reports whether x is a jwkKey with the same key and algorithm.
+func (k *jwkKey) Equal(x crypto.PublicKey) bool {
+	other, ok := x.(*jwkKey)
+	return ok && k.algorithm == other.algorithm && equalKeys(k.key, other.key)
+}
+
+// keyAlgorithm returns the key and the signature algorithm it must be used
+// with: the algorithm declared by its JSON Web Key, or for bare keys RS256 for
+// RSA keys and ES256 for EC P-256 keys.
+func keyAlgorithm(key crypto.PublicKey) (crypto.PublicKey, string) {
+	if k, ok := key.(*jwkKey); ok {
+		if k.algorithm != "" {
+			return k.key, k.algorithm
+		}
+		key = k.key
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k, "RS256"
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return k, "ES256"
+		}
+	}
+	return key, ""
+}
+
+// verifySignature verifies the token signature with the given public key. The
+// algorithm of the token header must be the one of the key, which must be
+// RS256 or ES256, so the none algorithm, symmetric algorithms and algorithm
+// substitutions are rejected with ErrUnsupportedAlgorithm.
+func (t *jwtToken) verifySignature(key crypto.PublicKey) error {
+	key, algorithm := keyAlgorithm(key)
+	if t.header.Algorithm != algorithm {
+		return ErrUnsupportedAlgorithm
+	}
+	hashed := sha256.Sum256([]byte(t.signingInput))
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedAlgorithm
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], t.signature); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return ErrUnsupportedAlgorithm
+		}
+		// JWS encodes ECDSA signatures as the concatenation of r and s.
+		if len(t.signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:32])
+		sig := new(big.Int).SetBytes(t.signature[32:])
+		if !ecdsa.Verify(ecKey, hashed[:], r, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return ErrUnsupportedAlgorithm
+	}
+}
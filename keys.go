@@ -0,0 +1,562 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keysEndpoint = "https://appleid.apple.com/auth/keys"
+
+// defaultKeysTimeout the default timeout of requests to Apple keys endpoint.
+const defaultKeysTimeout = 5 * time.Second
+
+// minKeyMissRefreshInterval the minimum time between a fetch of the keys and a
+// fetch triggered by an unknown key id, so tokens with made up key ids can't
+// flood Apple keys endpoint.
+const minKeyMissRefreshInterval = time.Minute
+
+// jsonWebKey is a key published by Apple to verify the signature of id tokens.
+type jsonWebKey struct {
+	KeyType   string   `json:"kty"`
+	KeyID     string   `json:"kid"`
+	Use       string   `json:"use"`
+	Algorithm string   `json:"alg"`
+	N         string   `json:"n,omitempty"`
+	E         string   `json:"e,omitempty"`
+	Curve     string   `json:"crv,omitempty"`
+	X         string   `json:"x,omitempty"`
+	Y         string   `json:"y,omitempty"`
+	X5C       []string `json:"x5c,omitempty"`
+}
+
+// jsonWebKeySet is the key set served by Apple keys endpoint.
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKey converts the JSON Web Key into an RSA or EC P-256 public key,
+// along with its declared algorithm. Keys without their parameters are read
+// from the leaf certificate of their x5c chain.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	var key crypto.PublicKey
+	var err error
+	switch {
+	case k.KeyType == "RSA" && k.N == "" && k.E == "" && len(k.X5C) > 0,
+		k.KeyType == "EC" && k.X == "" && k.Y == "" && len(k.X5C) > 0:
+		key, err = k.certificatePublicKey()
+	case k.KeyType == "RSA":
+		key, err = k.rsaPublicKey()
+	case k.KeyType == "EC":
+		key, err = k.ecPublicKey()
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.KeyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &jwkKey{key: key, algorithm: k.Algorithm}, nil
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key exponent: %w", err)
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() <= 0 {
+		return nil, errors.New("invalid key exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+func (k jsonWebKey) ecPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Curve != "P-256" {
+		return nil, fmt.Errorf("unsupported key curve: %s", k.Curve)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key x coordinate: %w", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key y coordinate: %w", err)
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("invalid key point")
+	}
+	return key, nil
+}
+
+// certificatePublicKey returns the public key of the leaf certificate of the
+// x5c chain, which must be of the key type. The chain is not verified, the key
+// set is trusted as served over TLS by Apple keys endpoint.
+func (k jsonWebKey) certificatePublicKey() (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(k.X5C[0])
+	if err != nil {
+		return nil, fmt.Errorf("decoding key certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key certificate: %w", err)
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if k.KeyType == "RSA" {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if k.KeyType == "EC" && key.Curve == elliptic.P256() {
+			return key, nil
+		}
+	}
+	return nil, errors.New("key certificate does not match the key type")
+}
+
+// keySource provides the public keys to verify id token signatures.
+type keySource interface {
+	// keyFor returns the public key with the given key id.
+	keyFor(ctx context.Context, kid string) (crypto.PublicKey, error)
+
+	// keys returns all the public keys.
+	keys(ctx context.Context) ([]crypto.PublicKey, error)
+}
+
+// staticKeySource is a keySource of a fixed set of keys indexed by their key
+// id, for verification without fetching keys.
+type staticKeySource map[string]crypto.PublicKey
+
+func (s staticKeySource) keyFor(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (s staticKeySource) keys(ctx context.Context) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(s))
+	for _, key := range s {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// keyCache holds Apple public keys indexed by their key id. After a rotation
+// the previous key set is kept along with the latest one for the max age of
+// the latest one, so tokens signed with a key Apple just retired or just
+// published both verify during a rotation.
+type keyCache struct {
+	mu                sync.RWMutex
+	keys              map[string]crypto.PublicKey
+	previous          map[string]crypto.PublicKey
+	expiresAt         time.Time
+	previousExpiresAt time.Time
+}
+
+func (c *keyCache) get(kid string, now time.Time) (crypto.PublicKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, true
+	}
+	if !now.Before(c.previousExpiresAt) {
+		return nil, false
+	}
+	key, ok := c.previous[kid]
+	return key, ok
+}
+
+func (c *keyCache) all(now time.Time) []crypto.PublicKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]crypto.PublicKey, 0, len(c.keys)+len(c.previous))
+	for _, key := range c.keys {
+		keys = append(keys, key)
+	}
+	if !now.Before(c.previousExpiresAt) {
+		return keys
+	}
+	for kid, key := range c.previous {
+		if current, ok := c.keys[kid]; !ok || !equalKeys(current, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// expired reports whether the keys are older than the max age Apple allowed.
+func (c *keyCache) expired(now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !now.Before(c.expiresAt)
+}
+
+func (c *keyCache) set(keys map[string]crypto.PublicKey, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !sameKeys(c.keys, keys) {
+		c.previous = c.keys
+		c.previousExpiresAt = expiresAt
+	}
+	c.keys = keys
+	c.expiresAt = expiresAt
+}
+
+// sameKeys reports whether both key sets hold the same keys under the same key
+// ids.
+func sameKeys(a, b map[string]crypto.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for kid, key := range a {
+		other, ok := b[kid]
+		if !ok {
+			return false
+		}
+		if !equalKeys(key, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalKeys reports whether both public keys are the same key.
+func equalKeys(a, b crypto.PublicKey) bool {
+	if k, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return k.Equal(b)
+	}
+	return a == b
+}
+
+// jwksKeySource is the keySource of Apple public keys published in the keys
+// endpoint. Keys are cached for the max age of the Cache-Control header of
+// the keys endpoint, keysCacheTTL when absent, and fetched again when the key
+// id is unknown, which handles Apple key rotation, at most once every
+// minKeyMissRefreshInterval. Concurrent fetches are collapsed into one.
+type jwksKeySource struct {
+	// fetch returns the keys along with their max age, zero when unknown.
+	fetch func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error)
+	// load returns the keys of the shared cache along with their remaining
+	// max age, zero when unknown.
+	load func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, bool)
+	// start runs the fetch in the background with a context canceled on
+	// Close, or returns ErrClosed. The fetch runs on context.Background()
+	// when nil.
+	start func(run func(ctx context.Context)) error
+	now   func() time.Time
+	cache keyCache
+
+	mu        sync.Mutex
+	inflight  *keyFetch
+	lastFetch time.Time
+}
+
+// keyFetch is a fetch of the keys in progress, shared by concurrent callers.
+type keyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func (s *jwksKeySource) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// set caches the keys for maxAge, or keysCacheTTL when zero.
+func (s *jwksKeySource) set(keys map[string]crypto.PublicKey, maxAge time.Duration) {
+	if maxAge <= 0 {
+		maxAge = keysCacheTTL
+	}
+	s.cache.set(keys, s.clock().Add(maxAge))
+}
+
+// refresh fetches the keys from Apple and caches them.
+func (s *jwksKeySource) refresh(ctx context.Context) error {
+	return s.refreshIf(ctx, false)
+}
+
+// refreshIf fetches the keys as refresh does, joining the fetch in progress if
+// any. When onMiss is set, no new fetch is started within
+// minKeyMissRefreshInterval of the last completed one and ErrKeyNotFound is
+// returned. The caller stops waiting when ctx is done, without aborting the
+// fetch shared with the other callers.
+func (s *jwksKeySource) refreshIf(ctx context.Context, onMiss bool) error {
+	s.mu.Lock()
+	fetch := s.inflight
+	if fetch == nil {
+		if onMiss && !s.lastFetch.IsZero() && s.clock().Sub(s.lastFetch) < minKeyMissRefreshInterval {
+			s.mu.Unlock()
+			return ErrKeyNotFound
+		}
+		fetch = &keyFetch{done: make(chan struct{})}
+		s.inflight = fetch
+		s.mu.Unlock()
+		if err := s.startFetch(fetch); err != nil {
+			s.finishFetch(fetch, err)
+		}
+	} else {
+		s.mu.Unlock()
+	}
+
+	select {
+	case <-fetch.done:
+		return fetch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startFetch runs the fetch shared by the callers in the background. No
+// caller can cancel it, it is bounded by the keys timeout and canceled on
+// Close instead.
+func (s *jwksKeySource) startFetch(fetch *keyFetch) error {
+	run := func(ctx context.Context) {
+		keys, maxAge, err := s.fetch(ctx)
+		if err == nil {
+			s.set(keys, maxAge)
+		}
+		s.finishFetch(fetch, err)
+	}
+	if s.start == nil {
+		go run(context.Background())
+		return nil
+	}
+	return s.start(run)
+}
+
+// finishFetch records the outcome of the fetch and wakes up its callers.
+func (s *jwksKeySource) finishFetch(fetch *keyFetch, err error) {
+	fetch.err = err
+	s.mu.Lock()
+	s.inflight = nil
+	s.lastFetch = s.clock()
+	s.mu.Unlock()
+	close(fetch.done)
+}
+
+// loadShared returns the keys of the shared cache, if any, when they hold the
+// key id or any key when kid is empty, along with their remaining max age.
+func (s *jwksKeySource) loadShared(ctx context.Context, kid string) (map[string]crypto.PublicKey, time.Duration, bool) {
+	if s.load == nil {
+		return nil, 0, false
+	}
+	keys, maxAge, ok := s.load(ctx)
+	if !ok || len(keys) == 0 {
+		return nil, 0, false
+	}
+	if _, found := keys[kid]; kid != "" && !found {
+		return nil, 0, false
+	}
+	return keys, maxAge, true
+}
+
+func (s *jwksKeySource) keyFor(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	stale, cached := s.cache.get(kid, s.clock())
+	if cached && !s.cache.expired(s.clock()) {
+		return stale, nil
+	}
+	if keys, maxAge, ok := s.loadShared(ctx, kid); ok {
+		s.set(keys, maxAge)
+		return keys[kid], nil
+	}
+	// A key id missing from fresh keys is a miss, whose refreshes are rate
+	// limited. Expired or never fetched keys are always refreshed.
+	miss := !cached && !s.cache.expired(s.clock())
+	if err := s.refreshIf(ctx, miss); err != nil {
+		// An expired key beats failing every verification while Apple is
+		// unreachable.
+		if cached {
+			return stale, nil
+		}
+		return nil, err
+	}
+	key, ok := s.cache.get(kid, s.clock())
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *jwksKeySource) keys(ctx context.Context) ([]crypto.PublicKey, error) {
+	stale := s.cache.all(s.clock())
+	if len(stale) > 0 && !s.cache.expired(s.clock()) {
+		return stale, nil
+	}
+	if keys, maxAge, ok := s.loadShared(ctx, ""); ok {
+		s.set(keys, maxAge)
+		return s.cache.all(s.clock()), nil
+	}
+	if err := s.refresh(ctx); err != nil {
+		if len(stale) > 0 {
+			return stale, nil
+		}
+		return nil, err
+	}
+	return s.cache.all(s.clock()), nil
+}
+
+// RefreshKeys fetches Apple public keys, replacing the cached ones, for
+// instance to warm the cache at startup. It does nothing when the keys are
+// not fetched from Apple.
+func (a *appleAuth) RefreshKeys(ctx context.Context) error {
+	source, ok := a.keySource.(*jwksKeySource)
+	if !ok {
+		return nil
+	}
+	return source.refresh(ctx)
+}
+
+// fetchKeys retrieves the current key set from Apple keys endpoint, within the
+// keys timeout or the deadline of ctx, whichever comes first, along with the
+// max age of its Cache-Control header.
+func (a *appleAuth) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+	timeout := a.keysTimeout
+	if timeout <= 0 {
+		timeout = defaultKeysTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := a.newRequest(ctx, http.MethodGet, keysEndpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := a.do(req, true)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetching keys: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status fetching keys: %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys, err := decodeKeySet(bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, fmt.Errorf("decoding keys: %w", err)
+	}
+	maxAge := cacheControlMaxAge(res.Header)
+	ttl := maxAge
+	if ttl <= 0 {
+		ttl = keysCacheTTL
+	}
+	shared, err := json.Marshal(cachedKeySet{ExpiresAt: a.now().Add(ttl), Keys: body})
+	if err == nil {
+		a.cacheSet(ctx, keysCacheKey, shared, ttl)
+	}
+	return keys, maxAge, nil
+}
+
+// cacheControlMaxAge returns the max-age directive of the Cache-Control
+// header, zero when absent or invalid.
+func cacheControlMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, found := cutDirective(strings.TrimSpace(directive))
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil || seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// cutDirective splits a Cache-Control directive around its equal sign.
+func cutDirective(directive string) (string, string, bool) {
+	i := strings.IndexByte(directive, '=')
+	if i < 0 {
+		return directive, "", false
+	}
+	return directive[:i], directive[i+1:], true
+}
+
+// cachedKeySet is the key set stored in the Cache along with when it expires,
+// so instances reading it keep it no longer than the max age Apple allowed.
+type cachedKeySet struct {
+	ExpiresAt time.Time       `json:"expires_at"`
+	Keys      json.RawMessage `json:"jwks"`
+}
+
+// loadCachedKeys returns the key set stored in the cache by another fetch,
+// possibly of another instance, along with its remaining max age. Key sets
+// stored without their expiry have a zero max age.
+func (a *appleAuth) loadCachedKeys(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, bool) {
+	body, ok := a.cacheGet(ctx, keysCacheKey)
+	if !ok {
+		return nil, 0, false
+	}
+	var shared cachedKeySet
+	if err := json.Unmarshal(body, &shared); err == nil && len(shared.Keys) > 0 {
+		maxAge := shared.ExpiresAt.Sub(a.now())
+		if maxAge <= 0 {
+			return nil, 0, false
+		}
+		keys, err := decodeKeySet(bytes.NewReader(shared.Keys))
+		if err != nil {
+			return nil, 0, false
+		}
+		return keys, maxAge, true
+	}
+	keys, err := decodeKeySet(bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, false
+	}
+	return keys, 0, true
+}
+
+// decodeKeySet decodes a JSON Web Key Set into its public keys indexed by key
+// id. Keys of unsupported types are skipped.
+func decodeKeySet(r io.Reader) (map[string]crypto.PublicKey, error) {
+	var keySet jsonWebKeySet
+	if err := json.NewDecoder(r).Decode(&keySet); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,526 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWKSKeySource_Rotation(t *testing.T) {
+	oldKey := &newTestRSAKey(t).PublicKey
+	newKey := &newTestRSAKey(t).PublicKey
+	published := map[string]crypto.PublicKey{"old-kid": oldKey}
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetches := 0
+	source := &jwksKeySource{
+		fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+			fetches++
+			return published, 0, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	key, err := source.keyFor(context.Background(), "old-kid")
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey, key)
+	_, err = source.keyFor(context.Background(), "old-kid")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// Apple rotates its keys, the unknown key id triggers a new fetch.
+	now = now.Add(minKeyMissRefreshInterval)
+	published = map[string]crypto.PublicKey{"old-kid": oldKey, "new-kid": newKey}
+	key, err = source.keyFor(context.Background(), "new-kid")
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, key)
+	assert.Equal(t, 2, fetches)
+
+	// Unknown key ids right after a fetch don't fetch again.
+	_, err = source.keyFor(context.Background(), "unknown-kid")
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, fetches)
+
+	now = now.Add(minKeyMissRefreshInterval)
+	_, err = source.keyFor(context.Background(), "unknown-kid")
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 3, fetches)
+}
+
+func TestJWKSKeySource_UnknownKeyIDFlood(t *testing.T) {
+	key := newTestRSAKey(t)
+	var mu sync.Mutex
+	fetches := 0
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = &jwksKeySource{fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return map[string]crypto.PublicKey{testKeyID: &key.PublicKey}, 0, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": fmt.Sprintf("bogus-%d", i)}, newTestClaims())
+			_, err := auth.VerifyIDToken(context.Background(), token)
+			assert.Error(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fetches)
+}
+
+func TestJWKSKeySource_MaxAge(t *testing.T) {
+	key := &newTestRSAKey(t).PublicKey
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetches := 0
+	var fetchErr error
+	source := &jwksKeySource{
+		fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+			fetches++
+			return map[string]crypto.PublicKey{testKeyID: key}, time.Minute, fetchErr
+		},
+		now: func() time.Time { return now },
+	}
+
+	_, err := source.keyFor(context.Background(), testKeyID)
+	assert.NoError(t, err)
+	now = now.Add(59 * time.Second)
+	_, err = source.keyFor(context.Background(), testKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// The max age elapsed, the keys are fetched again.
+	now = now.Add(time.Second)
+	_, err = source.keyFor(context.Background(), testKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// Apple is unreachable, the expired key is still served.
+	now = now.Add(time.Minute)
+	fetchErr = errors.New("unreachable")
+	cached, err := source.keyFor(context.Background(), testKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, key, cached)
+	keys, err := source.keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []crypto.PublicKey{key}, keys)
+	assert.Equal(t, 4, fetches)
+}
+
+func TestJWKSKeySource_Concurrent(t *testing.T) {
+	key := &newTestRSAKey(t).PublicKey
+	source := &jwksKeySource{fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+		return map[string]crypto.PublicKey{testKeyID: key}, time.Nanosecond, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				got, err := source.keyFor(context.Background(), testKeyID)
+				assert.NoError(t, err)
+				assert.Equal(t, key, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestJWKSKeySource_CanceledCaller(t *testing.T) {
+	key := &newTestRSAKey(t).PublicKey
+	release := make(chan struct{})
+	var mu sync.Mutex
+	fetches := 0
+	source := &jwksKeySource{fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		<-release
+		return map[string]crypto.PublicKey{testKeyID: key}, 0, ctx.Err()
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := source.keyFor(ctx, testKeyID)
+		canceled <- err
+	}()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-canceled)
+
+	// The fetch started by the canceled caller goes on for the others.
+	joined := make(chan error)
+	go func() {
+		got, err := source.keyFor(context.Background(), testKeyID)
+		assert.Equal(t, key, got)
+		joined <- err
+	}()
+	close(release)
+	assert.NoError(t, <-joined)
+	mu.Lock()
+	assert.Equal(t, 1, fetches)
+	mu.Unlock()
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		maxAge       time.Duration
+	}{
+		{"max-age=3600", time.Hour},
+		{"public, max-age=600, must-revalidate", 10 * time.Minute},
+		{"Max-Age=60", time.Minute},
+		{"no-cache", 0},
+		{"max-age=soon", 0},
+		{"max-age=-1", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cacheControl, func(t *testing.T) {
+			header := http.Header{"Cache-Control": {tt.cacheControl}}
+			assert.Equal(t, tt.maxAge, cacheControlMaxAge(header))
+		})
+	}
+}
+
+func TestRefreshKeys(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key})
+	keyFetches := 0
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		keyFetches++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=86400"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(jwks)),
+		}, nil
+	})
+
+	assert.NoError(t, auth.RefreshKeys(context.Background()))
+	assert.Equal(t, 1, keyFetches)
+	_, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, keyFetches)
+
+	auth.keySource = staticKeySource{}
+	assert.NoError(t, auth.RefreshKeys(context.Background()))
+	assert.Equal(t, 1, keyFetches)
+}
+
+func TestVerifyIDToken_RotationGracePeriod(t *testing.T) {
+	oldKey := newTestRSAKey(t)
+	newKey := newTestRSAKey(t)
+	published := map[string]crypto.PublicKey{"old-kid": &oldKey.PublicKey}
+	now := time.Now()
+	fetches := 0
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = &jwksKeySource{
+		fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+			fetches++
+			return published, 0, nil
+		},
+		now: func() time.Time { return now },
+	}
+	oldToken := signTestToken(t, oldKey, map[string]interface{}{"alg": "RS256", "kid": "old-kid"}, newTestClaims())
+	newToken := signTestToken(t, newKey, map[string]interface{}{"alg": "RS256", "kid": "new-kid"}, newTestClaims())
+
+	_, err := auth.VerifyIDToken(context.Background(), oldToken)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// Apple publishes the new key and retires the old one at once.
+	now = now.Add(minKeyMissRefreshInterval)
+	published = map[string]crypto.PublicKey{"new-kid": &newKey.PublicKey}
+	_, err = auth.VerifyIDToken(context.Background(), newToken)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// Tokens signed with the old key before the rotation still verify.
+	_, err = auth.VerifyIDToken(context.Background(), oldToken)
+	assert.NoError(t, err)
+	oldTokenWithoutKeyID := signTestToken(t, oldKey, map[string]interface{}{"alg": "RS256"}, newTestClaims())
+	_, err = auth.VerifyIDToken(context.Background(), oldTokenWithoutKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestJWKSKeySource_RefreshAfterRotation(t *testing.T) {
+	oldKey := &newTestRSAKey(t).PublicKey
+	newKey := &newTestRSAKey(t).PublicKey
+	published := map[string]*rsa.PublicKey{"old-kid": oldKey}
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	source := &jwksKeySource{
+		// Every fetch decodes new keys, as fetching Apple keys endpoint does.
+		fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+			keys := make(map[string]crypto.PublicKey)
+			for kid, key := range published {
+				keys[kid] = &jwkKey{key: &rsa.PublicKey{N: key.N, E: key.E}, algorithm: "RS256"}
+			}
+			return keys, time.Minute, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	assert.NoError(t, source.refresh(context.Background()))
+	published = map[string]*rsa.PublicKey{"new-kid": newKey}
+	assert.NoError(t, source.refresh(context.Background()))
+
+	// Refreshes returning the same keys keep the retired key for the grace
+	// period.
+	for i := 0; i < 3; i++ {
+		now = now.Add(15 * time.Second)
+		assert.NoError(t, source.refresh(context.Background()))
+		_, ok := source.cache.get("old-kid", now)
+		assert.True(t, ok)
+	}
+
+	now = now.Add(15 * time.Second)
+	assert.NoError(t, source.refresh(context.Background()))
+	_, ok := source.cache.get("old-kid", now)
+	assert.False(t, ok)
+	assert.Len(t, source.cache.all(now), 1)
+	_, ok = source.cache.get("new-kid", now)
+	assert.True(t, ok)
+}
+
+func TestJWKSKeySource_NewKeyUnderSameKeyID(t *testing.T) {
+	oldKey := &newTestRSAKey(t).PublicKey
+	newKey := &newTestRSAKey(t).PublicKey
+	published := oldKey
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	source := &jwksKeySource{
+		fetch: func(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+			return map[string]crypto.PublicKey{testKeyID: &jwkKey{key: published, algorithm: "RS256"}}, time.Minute, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	assert.NoError(t, source.refresh(context.Background()))
+	published = newKey
+	assert.NoError(t, source.refresh(context.Background()))
+
+	// The new key material is a rotation, the old key stays in the grace set.
+	keys := source.cache.all(now)
+	assert.Len(t, keys, 2)
+	key, ok := source.cache.get(testKeyID, now)
+	assert.True(t, ok)
+	assert.Equal(t, newKey, key.(*jwkKey).key)
+	assert.Equal(t, oldKey, source.cache.previous[testKeyID].(*jwkKey).key)
+}
+
+func TestVerifyIDToken_RotatingKeySet(t *testing.T) {
+	oldKey := newTestRSAKey(t)
+	newKey := newTestRSAKey(t)
+	apple := newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{"old-kid": oldKey, "new-kid": newKey}), nil)
+	fetches := 0
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		fetches++
+		return apple.Do(req)
+	})
+
+	for kid, key := range map[string]*rsa.PrivateKey{"old-kid": oldKey, "new-kid": newKey} {
+		idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": kid}, newTestClaims())
+		_, err := auth.VerifyIDToken(context.Background(), idToken)
+		assert.NoError(t, err, kid)
+	}
+	// Both keys are cached from the single fetch, including for tokens without key id.
+	idToken := signTestToken(t, newKey, map[string]interface{}{"alg": "RS256"}, newTestClaims())
+	_, err := auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+}
+
+// Signs the claims with ES256 producing a compact JWT with the given header.
+func signTestES256Token(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]interface{}) string {
+	headerBytes, _ := json.Marshal(header)
+	claimsBytes, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes)
+	hashed := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken_AlgorithmFromJWK(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(newTestJWKS(map[string]*rsa.PrivateKey{"rsa-kid": rsaKey}), &keySet); err != nil {
+		t.Fatal(err)
+	}
+	keySet.Keys = append(keySet.Keys, jsonWebKey{
+		KeyType:   "EC",
+		KeyID:     "ec-kid",
+		Use:       "sig",
+		Algorithm: "ES256",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		Y:         base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+	})
+	jwks, _ := json.Marshal(keySet)
+	auth := newTestVerifier(t, jwks)
+
+	tests := []struct {
+		name    string
+		idToken string
+		err     error
+	}{
+		{"RS256", signTestToken(t, rsaKey, map[string]interface{}{"alg": "RS256", "kid": "rsa-kid"}, newTestClaims()), nil},
+		{"ES256", signTestES256Token(t, ecKey, map[string]interface{}{"alg": "ES256", "kid": "ec-kid"}, newTestClaims()), nil},
+		{"ES256 without kid", signTestES256Token(t, ecKey, map[string]interface{}{"alg": "ES256"}, newTestClaims()), nil},
+		{"algorithm not matching the JWK", signTestToken(t, rsaKey, map[string]interface{}{"alg": "RS256", "kid": "ec-kid"}, newTestClaims()), ErrUnsupportedAlgorithm},
+		{"none", signTestToken(t, rsaKey, map[string]interface{}{"alg": "none", "kid": "rsa-kid"}, newTestClaims()), ErrUnsupportedAlgorithm},
+		{"symmetric", signTestToken(t, rsaKey, map[string]interface{}{"alg": "HS256", "kid": "ec-kid"}, newTestClaims()), ErrUnsupportedAlgorithm},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := auth.VerifyIDToken(context.Background(), test.idToken)
+			assert.Equal(t, test.err, err)
+		})
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := signTestES256Token(t, otherKey, map[string]interface{}{"alg": "ES256", "kid": "ec-kid"}, newTestClaims())
+	_, err = auth.VerifyIDToken(context.Background(), forged)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestJSONWebKey_InvalidEC(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jsonWebKey{
+		KeyType: "EC",
+		Curve:   "P-384",
+		X:       base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		Y:       base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+	}
+	_, err = jwk.publicKey()
+	assert.Error(t, err)
+
+	jwk.Curve = "P-256"
+	_, err = jwk.publicKey()
+	assert.Error(t, err)
+}
+
+func TestFetchKeys_Timeout(t *testing.T) {
+	slowKeysServer := httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	t.Run("keys timeout", func(t *testing.T) {
+		auth := newAppleAuth("appID", "teamID", "keyID", nil, WithKeysTimeout(20*time.Millisecond))
+		auth.httpClient = slowKeysServer
+		start := time.Now()
+		_, _, err := auth.fetchKeys(context.Background())
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+
+	t.Run("sooner context deadline", func(t *testing.T) {
+		auth := newAppleAuth("appID", "teamID", "keyID", nil, WithKeysTimeout(time.Minute))
+		auth.httpClient = slowKeysServer
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, _, err := auth.fetchKeys(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		auth := newAppleAuth("appID", "teamID", "keyID", nil)
+		assert.Equal(t, defaultKeysTimeout, auth.keysTimeout)
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		_, err := NewFromKeyBytes("appID", "teamID", "keyID", newTestKeyContent(t), WithKeysTimeout(0))
+		assert.Error(t, err)
+	})
+}
+
+// Builds a self-signed certificate of the public key signed with the RSA key.
+func newTestCertificate(t *testing.T, signer *rsa.PrivateKey, publicKey crypto.PublicKey) string {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple test key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestVerifyIDToken_X5C(t *testing.T) {
+	key := newTestRSAKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySet := jsonWebKeySet{Keys: []jsonWebKey{
+		{KeyType: "RSA", KeyID: "rsa-kid", Use: "sig", Algorithm: "RS256", X5C: []string{newTestCertificate(t, key, &key.PublicKey)}},
+		{KeyType: "EC", KeyID: "ec-kid", Use: "sig", Algorithm: "ES256", X5C: []string{newTestCertificate(t, key, &ecKey.PublicKey)}},
+		{KeyType: "EC", KeyID: "mismatch-kid", Use: "sig", Algorithm: "ES256", X5C: []string{newTestCertificate(t, key, &key.PublicKey)}},
+		{KeyType: "RSA", KeyID: "invalid-kid", Use: "sig", Algorithm: "RS256", X5C: []string{"bm90IGEgY2VydGlmaWNhdGU="}},
+	}}
+	jwks, _ := json.Marshal(keySet)
+	auth := newTestVerifier(t, jwks)
+
+	_, err = auth.VerifyIDToken(context.Background(), signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "rsa-kid"}, newTestClaims()))
+	assert.NoError(t, err)
+	_, err = auth.VerifyIDToken(context.Background(), signTestES256Token(t, ecKey, map[string]interface{}{"alg": "ES256", "kid": "ec-kid"}, newTestClaims()))
+	assert.NoError(t, err)
+	// Keys whose certificate is invalid or of another type are skipped.
+	_, err = auth.VerifyIDToken(context.Background(), signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "mismatch-kid"}, newTestClaims()))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = auth.VerifyIDToken(context.Background(), signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "invalid-kid"}, newTestClaims()))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -0,0 +1,110 @@
+package apple
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lifecycle tracks the background work of an appleAuth and whether it is
+// closed.
+type lifecycle struct {
+	mu     sync.Mutex
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// context returns the context canceled on Close, created on first use.
+func (l *lifecycle) context() context.Context {
+	if l.ctx == nil {
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+	}
+	return l.ctx
+}
+
+// checkOpen returns ErrClosed once Close was called.
+func (a *appleAuth) checkOpen() error {
+	a.lifecycle.mu.Lock()
+	defer a.lifecycle.mu.Unlock()
+	if a.lifecycle.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// StartKeyRefresher fetches Apple public keys every interval in the
+// background, so a key rotation is picked up before the first token signed
+// with the new key arrives. Fetch failures are logged and the cached keys are
+// kept. The refresher stops on Close. It does nothing when the keys are not
+// fetched from Apple. The interval must be positive.
+func (a *appleAuth) StartKeyRefresher(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("key refresh interval must be positive, got %s", interval)
+	}
+	source, ok := a.keySource.(*jwksKeySource)
+	if !ok {
+		return nil
+	}
+	return a.startBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := source.refresh(ctx); err != nil && ctx.Err() == nil {
+					a.log(LogLevelWarn, "key refresh failed", map[string]interface{}{"error": err.Error()})
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// startBackground runs run in a goroutine with a context canceled on Close,
+// which waits for it to return. It returns ErrClosed once Close was called.
+func (a *appleAuth) startBackground(run func(ctx context.Context)) error {
+	a.lifecycle.mu.Lock()
+	defer a.lifecycle.mu.Unlock()
+	if a.lifecycle.closed {
+		return ErrClosed
+	}
+	ctx := a.lifecycle.context()
+	a.lifecycle.wg.Add(1)
+	go func() {
+		defer a.lifecycle.wg.Done()
+		run(ctx)
+	}()
+	return nil
+}
+
+// Close stops the key refresher and the key fetch in progress, waiting for
+// them to exit, and zeroes the
+// internal copy of the private key content, leaving the caller's slice as is.
+// Any later call fails with ErrClosed. Closing twice is a no-op.
+func (a *appleAuth) Close() error {
+	a.lifecycle.mu.Lock()
+	if a.lifecycle.closed {
+		a.lifecycle.mu.Unlock()
+		return nil
+	}
+	a.lifecycle.closed = true
+	if a.lifecycle.cancel != nil {
+		a.lifecycle.cancel()
+	}
+	a.lifecycle.mu.Unlock()
+	a.lifecycle.wg.Wait()
+
+	a.keyMu.Lock()
+	defer a.keyMu.Unlock()
+	for i := range a.KeyContent {
+		a.KeyContent[i] = 0
+	}
+	a.KeyContent = nil
+	a.privateKey = nil
+	a.signer = nil
+	return nil
+}
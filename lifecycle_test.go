@@ -0,0 +1,129 @@
+package apple
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartKeyRefresher(t *testing.T) {
+	key := newTestRSAKey(t)
+	apple := newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), nil)
+	var fetches int32
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&fetches, 1)
+		return apple.Do(req)
+	})
+
+	assert.NoError(t, auth.StartKeyRefresher(time.Millisecond))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&fetches) >= 2 }, time.Second, time.Millisecond)
+
+	_, ok := auth.keySource.(*jwksKeySource).cache.get(testKeyID, time.Now())
+	assert.True(t, ok)
+
+	// The refresher stops on Close.
+	assert.NoError(t, auth.Close())
+	count := atomic.LoadInt32(&fetches)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, count, atomic.LoadInt32(&fetches))
+}
+
+func TestStartKeyRefresher_InvalidInterval(t *testing.T) {
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = newTestAppleServer(nil, nil)
+	for _, interval := range []time.Duration{0, -time.Second} {
+		assert.Error(t, auth.StartKeyRefresher(interval), interval)
+	}
+	assert.NoError(t, auth.Close())
+}
+
+func TestClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	keyContent := newTestKeyContent(t)
+	original := append([]byte(nil), keyContent...)
+	auth := newAppleAuth("appID", "teamID", "keyID", keyContent)
+	internal := auth.KeyContent
+	auth.httpClient = newTestAppleServer(nil, nil)
+	assert.NoError(t, auth.StartKeyRefresher(time.Hour))
+
+	assert.NoError(t, auth.Close())
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	assert.Equal(t, make([]byte, len(internal)), internal)
+	assert.Nil(t, auth.KeyContent)
+	assert.Equal(t, original, keyContent)
+
+	_, err := auth.ValidateCode("code")
+	assert.Equal(t, ErrClosed, err)
+	_, err = auth.VerifyIDToken(context.Background(), "header.payload.signature")
+	assert.Equal(t, ErrClosed, err)
+	_, err = auth.KeyThumbprint()
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, auth.SetKey("keyID", newTestKeyContent(t)))
+	assert.Equal(t, ErrClosed, auth.StartKeyRefresher(time.Hour))
+	_, err = auth.ParseServerNotification(context.Background(), "header.payload.signature")
+	assert.Equal(t, ErrClosed, err)
+	assert.NoError(t, auth.Close())
+}
+
+func TestClose_KeyFetchInProgress(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	fetching := make(chan struct{})
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		close(fetching)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- auth.RefreshKeys(context.Background())
+	}()
+	<-fetching
+	assert.NoError(t, auth.Close())
+	assert.Error(t, <-refreshed)
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	assert.Equal(t, ErrClosed, auth.RefreshKeys(context.Background()))
+}
+
+func TestClose_SetKeyCallerSlice(t *testing.T) {
+	keyContent := newTestKeyContent(t)
+	original := append([]byte(nil), keyContent...)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	assert.NoError(t, auth.SetKey("keyID", keyContent))
+
+	assert.NoError(t, auth.Close())
+	assert.Equal(t, original, keyContent)
+}
+
+func TestClose_ConcurrentSigning(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := auth.signingKey()
+				assert.True(t, err == nil || errors.Is(err, ErrClosed), err)
+			}()
+		}
+		assert.NoError(t, auth.Close())
+		wg.Wait()
+	}
+}
@@ -0,0 +1,127 @@
+package apple
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// LogLevel the severity of a log entry.
+type LogLevel int
+
+// Log levels, from the most to the least verbose.
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// String returns the name of the level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Logger receives structured log entries. Fields never contain tokens, client
+// secrets nor user identifiers in clear.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(level LogLevel, msg string, fields map[string]interface{})
+
+// Log calls f.
+func (f LoggerFunc) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	f(level, msg, fields)
+}
+
+// log sends the entry to the configured logger when its level is enabled.
+func (a *appleAuth) log(level LogLevel, msg string, fields map[string]interface{}) {
+	if a.logger == nil || level < a.logLevel {
+		return
+	}
+	a.logger.Log(level, msg, fields)
+}
+
+// logVerification logs the outcome of an id token verification: info on
+// success and warn on failure, with the failure reason, the key id and the
+// SHA-256 hash of the subject. The token itself is never logged.
+func (a *appleAuth) logVerification(idToken string, err error) {
+	if a.logger == nil {
+		return
+	}
+	fields := map[string]interface{}{"outcome": "success"}
+	level := LogLevelInfo
+	if err != nil {
+		fields["outcome"] = "failure"
+		fields["reason"] = verificationFailureReason(err)
+		level = LogLevelWarn
+	}
+	if level < a.logLevel {
+		return
+	}
+	if token, decodeErr := decodeJWT(idToken); decodeErr == nil {
+		if token.header.KeyID != "" {
+			fields["kid"] = token.header.KeyID
+		}
+		if sub, ok := token.claims["sub"].(string); ok {
+			fields["sub_hash"] = hashSubject(sub)
+		}
+	}
+	a.log(level, "id token verification", fields)
+}
+
+// hashSubject returns the hex encoded SHA-256 hash of the subject, to
+// correlate log entries of a user without logging their identifier.
+func hashSubject(sub string) string {
+	sum := sha256.Sum256([]byte(sub))
+	return hex.EncodeToString(sum[:])
+}
+
+// verificationFailureReasons the log reasons of the verification errors.
+var verificationFailureReasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrMalformedIDToken, "malformed"},
+	{ErrInvalidSignature, "bad_signature"},
+	{ErrUnsupportedAlgorithm, "unsupported_algorithm"},
+	{ErrKeyNotFound, "key_not_found"},
+	{ErrMissingKeyID, "missing_key_id"},
+	{ErrNoMatchingKey, "no_matching_key"},
+	{ErrInvalidIssuer, "wrong_issuer"},
+	{ErrInvalidAudience, "wrong_audience"},
+	{ErrInvalidAuthorizedParty, "wrong_authorized_party"},
+	{ErrInvalidSubject, "invalid_subject"},
+	{ErrEmailDomainNotAllowed, "email_domain_not_allowed"},
+	{ErrRealUserStatusTooLow, "real_user_status_too_low"},
+	{ErrTokenExpired, "expired"},
+	{ErrTokenTooOld, "too_old"},
+	{ErrNonceMissing, "nonce_missing"},
+	{ErrNonceMismatch, "nonce_mismatch"},
+	{ErrInvalidCodeHash, "invalid_code_hash"},
+	{ErrInvalidAccessTokenHash, "invalid_access_token_hash"},
+}
+
+// verificationFailureReason returns a short reason for the verification
+// error, suited for aggregation.
+func verificationFailureReason(err error) string {
+	for _, r := range verificationFailureReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return "error"
+}
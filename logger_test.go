@@ -0,0 +1,65 @@
+package apple
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLogEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+func TestWithLogger_Verification(t *testing.T) {
+	key := newTestRSAKey(t)
+	var entries []testLogEntry
+	logger := LoggerFunc(func(level LogLevel, msg string, fields map[string]interface{}) {
+		entries = append(entries, testLogEntry{level, msg, fields})
+	})
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithLogger(logger, LogLevelInfo))
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	idToken := signTestToken(t, key, header, newTestClaims())
+
+	_, err := auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	claims := newTestClaims()
+	claims["aud"] = "anotherAppID"
+	wrongAudience := signTestToken(t, key, header, claims)
+	_, err = auth.VerifyIDToken(context.Background(), wrongAudience)
+	assert.Equal(t, ErrInvalidAudience, err)
+
+	subHash := hashSubject("001234.abcdef0123456789.0123")
+	assert.Equal(t, []testLogEntry{
+		{LogLevelInfo, "id token verification", map[string]interface{}{"outcome": "success", "kid": testKeyID, "sub_hash": subHash}},
+		{LogLevelWarn, "id token verification", map[string]interface{}{"outcome": "failure", "reason": "wrong_audience", "kid": testKeyID, "sub_hash": subHash}},
+	}, entries)
+	for _, entry := range entries {
+		for _, value := range entry.fields {
+			assert.NotContains(t, []string{idToken, wrongAudience, "001234.abcdef0123456789.0123"}, value)
+		}
+	}
+}
+
+func TestWithLogger_Level(t *testing.T) {
+	key := newTestRSAKey(t)
+	var entries []testLogEntry
+	logger := LoggerFunc(func(level LogLevel, msg string, fields map[string]interface{}) {
+		entries = append(entries, testLogEntry{level, msg, fields})
+	})
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithLogger(logger, LogLevelWarn))
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+
+	_, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims()))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = auth.VerifyIDToken(context.Background(), "not-a-jwt")
+	assert.Error(t, err)
+	assert.Equal(t, []testLogEntry{
+		{LogLevelWarn, "id token verification", map[string]interface{}{"outcome": "failure", "reason": "malformed"}},
+	}, entries)
+}
@@ -0,0 +1,55 @@
+package apple
+
+import (
+	"net/http"
+	"time"
+)
+
+// Verification outcomes reported to the MetricsHook.
+const (
+	VerificationSuccess = "success"
+	VerificationFailure = "failure"
+)
+
+// MetricsHook receives the events worth measuring. Implementations must be
+// safe for concurrent use and return quickly, they are called inline. See the
+// appleprom package for a Prometheus implementation.
+type MetricsHook interface {
+	// RequestDone is called after each request to Apple servers with the path
+	// of the endpoint, the status code of the response, zero when the request
+	// failed, and its duration.
+	RequestDone(endpoint string, statusCode int, duration time.Duration)
+
+	// VerificationDone is called after each id token verification with its
+	// outcome, VerificationSuccess or VerificationFailure, and the reason of
+	// the failure, such as expired or bad_signature.
+	VerificationDone(outcome, reason string)
+
+	// ClientSecretGenerated is called each time a client secret is signed.
+	ClientSecretGenerated()
+}
+
+// recordRequest reports a request to the metrics hook, if any.
+func (a *appleAuth) recordRequest(req *http.Request, res *http.Response, duration time.Duration) {
+	if a.metrics == nil {
+		return
+	}
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+	a.metrics.RequestDone(req.URL.Path, statusCode, duration)
+}
+
+// recordVerification reports an id token verification to the metrics hook,
+// if any.
+func (a *appleAuth) recordVerification(err error) {
+	if a.metrics == nil {
+		return
+	}
+	if err != nil {
+		a.metrics.VerificationDone(VerificationFailure, verificationFailureReason(err))
+		return
+	}
+	a.metrics.VerificationDone(VerificationSuccess, "")
+}
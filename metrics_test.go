@@ -0,0 +1,57 @@
+package apple
+
+import (
+	"context"
+	"crypto/rsa"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// MetricsHook recording the events it receives.
+type testMetricsHook struct {
+	mu            sync.Mutex
+	requests      []string
+	statusCodes   []int
+	verifications []string
+	clientSecrets int
+}
+
+func (h *testMetricsHook) RequestDone(endpoint string, statusCode int, duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, endpoint)
+	h.statusCodes = append(h.statusCodes, statusCode)
+}
+
+func (h *testMetricsHook) VerificationDone(outcome, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.verifications = append(h.verifications, outcome+":"+reason)
+}
+
+func (h *testMetricsHook) ClientSecretGenerated() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clientSecrets++
+}
+
+func TestWithMetricsHook(t *testing.T) {
+	key := newTestRSAKey(t)
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+	hook := &testMetricsHook{}
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t), WithMetricsHook(hook))
+	auth.httpClient = newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), &TokenResponse{IDToken: idToken, RefreshToken: "refresh-token"})
+
+	_, err := auth.ValidateCodeFull(context.Background(), "code", "")
+	assert.NoError(t, err)
+	_, err = auth.VerifyIDToken(context.Background(), "not-a-jwt")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"/auth/token", "/auth/keys"}, hook.requests)
+	assert.Equal(t, []int{200, 200}, hook.statusCodes)
+	assert.Equal(t, []string{VerificationSuccess + ":", VerificationFailure + ":malformed"}, hook.verifications)
+	assert.Equal(t, 1, hook.clientSecrets)
+}
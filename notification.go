@@ -0,0 +1,133 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Server to server notification event types.
+const (
+	// NotificationEmailDisabled the user stopped forwarding emails sent to the
+	// private relay address.
+	NotificationEmailDisabled = "email-disabled"
+
+	// NotificationEmailEnabled the user resumed forwarding emails sent to the
+	// private relay address.
+	NotificationEmailEnabled = "email-enabled"
+
+	// NotificationConsentRevoked the user stopped using Sign in with Apple
+	// with the app.
+	NotificationConsentRevoked = "consent-revoked"
+
+	// NotificationAccountDelete the user deleted their Apple account.
+	NotificationAccountDelete = "account-delete"
+)
+
+// ServerNotificationEvent the event of a server to server notification.
+type ServerNotificationEvent struct {
+	// Type the type of the event, one of the Notification constants.
+	Type string `json:"type"`
+
+	// Subject the unique identifier of the user.
+	Subject string `json:"sub"`
+
+	// Email the user email, set for email events.
+	Email string `json:"email,omitempty"`
+
+	// IsPrivateEmail whether the email is the private relay address.
+	IsPrivateEmail bool `json:"is_private_email,omitempty"`
+
+	// EventTime the time, in milliseconds since epoch, the event happened.
+	EventTime int64 `json:"event_time"`
+}
+
+// ServerNotification a server to server notification sent by Apple to the
+// endpoint registered in the Apple Developer portal.
+type ServerNotification struct {
+	// Issuer the issuer of the notification, always https://appleid.apple.com.
+	Issuer string `json:"iss"`
+
+	// Audience the client id of the app the notification is sent for.
+	Audience string `json:"aud"`
+
+	// IssuedAt the time, in seconds since epoch, the notification was issued.
+	IssuedAt int64 `json:"iat"`
+
+	// ID the unique identifier of the notification.
+	ID string `json:"jti"`
+
+	// Event the event notified.
+	Event ServerNotificationEvent `json:"events"`
+}
+
+// ParseServerNotification verifies the signature of a server to server
+// notification against Apple's public keys and returns it. The payload is the
+// JWT in the payload field of the JSON body posted by Apple. Its issuer must be
+// Apple and its audience the app id, or one of the client ids added with
+// WithClientIDs, otherwise ErrInvalidIssuer or ErrInvalidAudience is returned,
+// so spoofed notifications are rejected.
+func (a *appleAuth) ParseServerNotification(ctx context.Context, payload string) (*ServerNotification, error) {
+	if err := a.checkOpen(); err != nil {
+		return nil, err
+	}
+	token, err := decodeJWT(payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verifySignature(ctx, token); err != nil {
+		return nil, err
+	}
+
+	var notification ServerNotification
+	if iss, ok := token.claims["iss"].(string); ok {
+		notification.Issuer = iss
+	}
+	if !a.issuerMatches(notification.Issuer) {
+		return nil, ErrInvalidIssuer
+	}
+	if !a.hasAudience(token.claims) {
+		return nil, ErrInvalidAudience
+	}
+	if aud, ok := token.claims["aud"].(string); ok {
+		notification.Audience = aud
+	}
+	notification.IssuedAt, _ = numberClaim(token.claims, "iat")
+	if jti, ok := token.claims["jti"].(string); ok {
+		notification.ID = jti
+	}
+
+	events, err := notificationEvents(token.claims["events"])
+	if err != nil {
+		return nil, err
+	}
+	if eventType, ok := events["type"].(string); ok {
+		notification.Event.Type = eventType
+	}
+	if sub, ok := events["sub"].(string); ok {
+		notification.Event.Subject = sub
+	}
+	if email, ok := events["email"].(string); ok {
+		notification.Event.Email = email
+	}
+	notification.Event.IsPrivateEmail, _ = boolClaim(events, "is_private_email")
+	notification.Event.EventTime, _ = numberClaim(events, "event_time")
+	return &notification, nil
+}
+
+// notificationEvents decodes the events claim, which Apple sends as a JSON
+// encoded string rather than an object.
+func notificationEvents(claim interface{}) (map[string]interface{}, error) {
+	switch events := claim.(type) {
+	case map[string]interface{}:
+		return events, nil
+	case string:
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(events), &decoded); err != nil {
+			return nil, fmt.Errorf("decoding notification events: %w", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unexpected notification events: %v", claim)
+	}
+}
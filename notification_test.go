@@ -0,0 +1,87 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns valid server notification claims for the appID audience.
+func newTestNotificationClaims(t *testing.T) map[string]interface{} {
+	events, err := json.Marshal(map[string]interface{}{
+		"type":             NotificationEmailDisabled,
+		"sub":              "001234.abcdef0123456789.0123",
+		"email":            "abc123@privaterelay.appleid.com",
+		"is_private_email": "true",
+		"event_time":       1508184845000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"iss":    appleAudience,
+		"aud":    "appID",
+		"iat":    time.Now().Unix(),
+		"jti":    "notification-id",
+		"events": string(events),
+	}
+}
+
+func TestParseServerNotification(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	payload := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestNotificationClaims(t))
+
+	notification, err := auth.ParseServerNotification(context.Background(), payload)
+	assert.NoError(t, err)
+	assert.Equal(t, &ServerNotification{
+		Issuer:   appleAudience,
+		Audience: "appID",
+		IssuedAt: notification.IssuedAt,
+		ID:       "notification-id",
+		Event: ServerNotificationEvent{
+			Type:           NotificationEmailDisabled,
+			Subject:        "001234.abcdef0123456789.0123",
+			Email:          "abc123@privaterelay.appleid.com",
+			IsPrivateEmail: true,
+			EventTime:      1508184845000,
+		},
+	}, notification)
+}
+
+func TestParseServerNotification_Invalid(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+
+	tests := []struct {
+		name   string
+		mutate func(claims map[string]interface{})
+		err    error
+	}{
+		{"wrong audience", func(claims map[string]interface{}) { claims["aud"] = "anotherAppID" }, ErrInvalidAudience},
+		{"wrong issuer", func(claims map[string]interface{}) { claims["iss"] = "https://example.com" }, ErrInvalidIssuer},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := newTestNotificationClaims(t)
+			test.mutate(claims)
+			_, err := auth.ParseServerNotification(context.Background(), signTestToken(t, key, header, claims))
+			assert.Equal(t, test.err, err)
+		})
+	}
+
+	otherKey := newTestRSAKey(t)
+	_, err := auth.ParseServerNotification(context.Background(), signTestToken(t, otherKey, header, newTestNotificationClaims(t)))
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	claims := newTestNotificationClaims(t)
+	claims["events"] = "not json"
+	_, err = auth.ParseServerNotification(context.Background(), signTestToken(t, key, header, claims))
+	assert.Error(t, err)
+}
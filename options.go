@@ -0,0 +1,314 @@
+package apple
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Option configures optional behavior of the AppleAuth returned by New.
+type Option func(*appleAuth)
+
+// WithRequestDecorator registers a function invoked on every outgoing request
+// to Apple servers right before it is sent. It can be used to add headers
+// required by an internal gateway or to rewrite the request method and URL.
+// The form body is already encoded when the decorator runs, so it can't
+// overwrite fields such as the client secret by accident.
+func WithRequestDecorator(decorator func(*http.Request)) Option {
+	return func(a *appleAuth) {
+		a.requestDecorator = decorator
+	}
+}
+
+// WithResponseValidator registers a function called with every successfully
+// decoded token response. A non-nil error returned by the validator is
+// returned by the method that issued the request, allowing callers to enforce
+// their own invariants on Apple's responses.
+func WithResponseValidator(validator func(*TokenResponse) error) Option {
+	return func(a *appleAuth) {
+		a.responseValidator = validator
+	}
+}
+
+// WithRequireNonceSupported makes the nonce check of VerifyOptions.ExpectedNonce
+// lenient: a token without a nonce claim is accepted when it does not report
+// nonce_supported as true, which happens on platforms unable to carry the
+// nonce. A token with a nonce claim must still match the expected nonce.
+func WithRequireNonceSupported() Option {
+	return func(a *appleAuth) {
+		a.requireNonceSupported = true
+	}
+}
+
+// WithNormalizeEmail lowercases the email of the users returned from verified
+// id tokens, so it can be used as a lookup key regardless of the case Apple
+// sends it with. The email as sent by Apple is kept in AppleUser.RawEmail.
+// The email of the verified claims, such as ExchangeResult.Claims, is
+// normalized the same way, while raw claims are left untouched.
+func WithNormalizeEmail() Option {
+	return func(a *appleAuth) {
+		a.normalizeEmail = true
+	}
+}
+
+// WithStripRelayDots normalizes emails as WithNormalizeEmail and also removes
+// the dots of the local part of private relay addresses, which Apple ignores
+// when relaying, so a.b@privaterelay.appleid.com and ab@privaterelay.appleid.com
+// map to the same user. Other addresses keep their dots.
+func WithStripRelayDots() Option {
+	return func(a *appleAuth) {
+		a.normalizeEmail = true
+		a.stripRelayDots = true
+	}
+}
+
+// WithMaxTokenAge rejects, with ErrTokenTooOld, verified id tokens issued more
+// than d ago, independently of their expiration. It reduces the window in
+// which a captured token can be replayed in login flows.
+func WithMaxTokenAge(d time.Duration) Option {
+	return func(a *appleAuth) {
+		a.maxTokenAge = d
+	}
+}
+
+// WithRequestRecorder writes a dump of every request sent to Apple and of its
+// response to w, which helps when reporting issues to Apple. Client secrets,
+// authorization codes and tokens are redacted from the dump, along with the
+// Authorization, Cookie and Set-Cookie headers and the headers named in
+// redactHeaders, such as credentials added by WithRequestDecorator.
+func WithRequestRecorder(w io.Writer, redactHeaders ...string) Option {
+	return func(a *appleAuth) {
+		a.recorder = newRequestRecorder(w, redactHeaders)
+	}
+}
+
+// WithCircuitBreaker stops sending requests to Apple, failing fast with
+// ErrCircuitOpen, after consecutive network errors or 5xx responses, until a
+// cooldown elapses. Business errors such as invalid_grant are not failures.
+func WithCircuitBreaker(opts CircuitBreakerOptions) Option {
+	return func(a *appleAuth) {
+		a.breaker = newCircuitBreaker(opts, a.now)
+	}
+}
+
+// WithMaxConcurrency bounds to n the number of requests to Apple in flight at
+// the same time, a request being in flight until its response body is read
+// and closed. Callers above the limit wait for a slot, or until their context
+// is done. A non positive n means no limit.
+func WithMaxConcurrency(n int) Option {
+	return func(a *appleAuth) {
+		if n > 0 {
+			a.semaphore = make(chan struct{}, n)
+		} else {
+			a.semaphore = nil
+		}
+	}
+}
+
+// WithMaxRetries retries up to n times the requests to Apple failing with a
+// network error or a 5xx response. Retries are disabled by default. As
+// authorization codes are single use, code exchanges are only retried when
+// the connection to Apple failed, refresh token and keys requests are retried
+// on any transient failure.
+func WithMaxRetries(n int) Option {
+	return func(a *appleAuth) {
+		a.maxRetries = n
+	}
+}
+
+// WithBackoff sets the function computing the delay before each retry, the
+// first retry being attempt 1. DefaultBackoff is used when not set. A retry
+// whose delay would go past the request context deadline is not attempted.
+func WithBackoff(backoff func(attempt int) time.Duration) Option {
+	return func(a *appleAuth) {
+		a.backoff = backoff
+	}
+}
+
+// WithVerificationCache keeps up to size verified id tokens in memory until
+// they expire, so verifying the same token again skips the signature
+// verification. Expiration, maximum age and VerifyOptions checks are still
+// performed on every verification.
+func WithVerificationCache(size int) Option {
+	return func(a *appleAuth) {
+		if size > 0 {
+			a.verificationCache = newVerificationCache(size)
+		} else {
+			a.verificationCache = nil
+		}
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the maximum idle connections to Apple kept
+// open for reuse by the default HTTP client, 16 by default. Raising it helps
+// under high login volume. It has no effect when the HTTP client is replaced
+// with WithHTTPClient.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(a *appleAuth) {
+		if a.transport != nil {
+			a.transport.MaxIdleConnsPerHost = n
+		}
+	}
+}
+
+// WithValidateSubjectFormat rejects, with ErrInvalidSubject, verified id tokens
+// whose sub claim does not have the format of Apple user identifiers, digits,
+// hexadecimal characters and digits separated by dots. It is not a security
+// control, it catches grossly malformed tokens early.
+func WithValidateSubjectFormat() Option {
+	return func(a *appleAuth) {
+		a.validateSubjectFormat = true
+	}
+}
+
+// WithAllowedEmailDomains rejects, with ErrEmailDomainNotAllowed, verified id
+// tokens whose email is not in one of the given domains, compared case
+// insensitively. Tokens without email are rejected too. Private relay
+// addresses, used when the user hides their email, are always accepted as
+// their domain says nothing about the user.
+func WithAllowedEmailDomains(domains ...string) Option {
+	return func(a *appleAuth) {
+		a.allowedEmailDomains = make(map[string]bool, len(domains))
+		for _, domain := range domains {
+			a.allowedEmailDomains[strings.ToLower(domain)] = true
+		}
+	}
+}
+
+// WithClientIDs adds the client ids of other apps of the team, such as the
+// Services ID of a website, which share the key. Id tokens issued to any of
+// them are verified, and ExchangeWithClientID sends requests on their behalf
+// with client secrets signed for them.
+func WithClientIDs(clientIDs ...string) Option {
+	return func(a *appleAuth) {
+		a.clientIDs = append(a.clientIDs, clientIDs...)
+	}
+}
+
+// WithLogger sends structured log entries of level and above to the logger.
+// Every id token verification is logged with its outcome, the failure reason,
+// the key id and the hashed subject, providing an audit trail of sign ins.
+func WithLogger(logger Logger, level LogLevel) Option {
+	return func(a *appleAuth) {
+		a.logger = logger
+		a.logLevel = level
+	}
+}
+
+// WithMetricsHook reports requests to Apple, id token verifications and
+// client secret generations to the hook.
+func WithMetricsHook(hook MetricsHook) Option {
+	return func(a *appleAuth) {
+		a.metrics = hook
+	}
+}
+
+// WithKeysTimeout sets the timeout of requests to Apple keys endpoint, 5
+// seconds by default, independently of the timeout of the token requests. The
+// deadline of the context, when sooner, still applies. The timeout must be
+// positive, as key fetches shared by concurrent callers can't be canceled by
+// any of them.
+func WithKeysTimeout(timeout time.Duration) Option {
+	return func(a *appleAuth) {
+		a.keysTimeout = timeout
+	}
+}
+
+// WithEmailClaimName reads the email of verified id tokens from the named
+// claim instead of the email claim, for enterprise tokens carrying the contact
+// address under another name. The email claim is used when name is empty.
+func WithEmailClaimName(name string) Option {
+	return func(a *appleAuth) {
+		if name == "email" {
+			name = ""
+		}
+		a.emailClaimName = name
+	}
+}
+
+// WithPreferServerTime uses Apple's clock, learned from the Date header of its
+// responses, for the iat and exp of client secrets and the expiry checks of id
+// tokens, so a host with a skewed clock neither signs client secrets Apple
+// rejects nor misjudges token expiry. The offset with the local clock is a
+// rolling estimate, zero until the first response from Apple.
+func WithPreferServerTime() Option {
+	return func(a *appleAuth) {
+		a.serverClock = &serverClock{}
+	}
+}
+
+// WithCache stores the key set fetched from Apple and the signed client
+// secrets in the cache instead of memory. Backed by a store shared by a fleet
+// of instances, such as Redis, the keys are fetched and the client secret is
+// signed once for the fleet. The client secrets are bearer credentials, the
+// store must be protected accordingly.
+func WithCache(cache Cache) Option {
+	return func(a *appleAuth) {
+		a.cache = cache
+	}
+}
+
+// WithMinRealUserStatus rejects, with ErrRealUserStatusTooLow, verified id
+// tokens whose real user status is below min, such as RealUserStatusLikelyReal
+// for fraud sensitive apps. Tokens from platforms not supporting the status,
+// before iOS 14, have RealUserStatusUnsupported and are rejected too, unless
+// WithAllowUnsupportedRealUserStatus is set.
+func WithMinRealUserStatus(min RealUserStatus) Option {
+	return func(a *appleAuth) {
+		a.minRealUserStatus = min
+	}
+}
+
+// WithAllowUnsupportedRealUserStatus accepts the id tokens with
+// RealUserStatusUnsupported, from platforms not supporting the status,
+// regardless of WithMinRealUserStatus.
+func WithAllowUnsupportedRealUserStatus() Option {
+	return func(a *appleAuth) {
+		a.allowUnsupportedRealUserStatus = true
+	}
+}
+
+// WithClientSecretTTL sets the lifetime of the generated client secrets, just
+// under 6 months by default, for instance to keep them short lived when keys
+// are rotated often. It must not exceed the 15777000 seconds Apple accepts,
+// otherwise the constructor returns ErrInvalidClientSecretTTL.
+func WithClientSecretTTL(ttl time.Duration) Option {
+	return func(a *appleAuth) {
+		a.clientSecretLifetime = ttl
+	}
+}
+
+// WithTimeout sets the timeout of the requests of the default HTTP client to
+// Apple servers, 10 seconds by default. It has no effect when the HTTP client
+// is replaced with WithHTTPClient.
+func WithTimeout(timeout time.Duration) Option {
+	return func(a *appleAuth) {
+		if a.defaultClient != nil {
+			a.defaultClient.Timeout = timeout
+		}
+	}
+}
+
+// WithTokenEndpoint sets the url of the token endpoint, Apple's by default,
+// for instance to go through a proxy or to test against a fake Apple server.
+func WithTokenEndpoint(endpoint string) Option {
+	return func(a *appleAuth) {
+		a.tokenEndpoint = endpoint
+	}
+}
+
+// WithHTTPClient sets the HTTP client of the requests to Apple servers, for
+// instance to go through a corporate proxy, trust custom TLS roots or trace
+// requests. The client is used as is: its timeout is not overridden, and
+// WithTimeout and WithMaxIdleConnsPerHost have no effect.
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *appleAuth) {
+		if client == nil {
+			return
+		}
+		a.httpClient = client
+		a.defaultClient = nil
+		a.transport = nil
+	}
+}
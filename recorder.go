@@ -0,0 +1,155 @@
+package apple
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+const redacted = "REDACTED"
+
+var (
+	// sensitiveFormFields form fields of requests to Apple redacted by the recorder.
+	sensitiveFormFields = []string{"client_secret", "code", "refresh_token", "token"}
+
+	// sensitiveResponseFields response body fields redacted by the recorder.
+	sensitiveResponseFields = []string{"access_token", "id_token", "refresh_token"}
+
+	// sensitiveHeaders headers redacted by the recorder.
+	sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+)
+
+// requestRecorder writes a redacted dump of requests to Apple and their
+// responses.
+type requestRecorder struct {
+	mu            sync.Mutex
+	w             io.Writer
+	redactHeaders map[string]bool
+}
+
+// newRequestRecorder returns a recorder writing to w, redacting the
+// sensitiveHeaders and the given headers.
+func newRequestRecorder(w io.Writer, redactHeaders []string) *requestRecorder {
+	r := &requestRecorder{w: w, redactHeaders: make(map[string]bool)}
+	for _, name := range sensitiveHeaders {
+		r.redactHeaders[name] = true
+	}
+	for _, name := range redactHeaders {
+		r.redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	return r
+}
+
+// record writes the request and its response, or the error returned when
+// sending it. Up to maxErrorBodySize bytes of the response body are read for
+// the dump and put back so the body can still be consumed by the caller.
+func (r *requestRecorder) record(req *http.Request, res *http.Response, err error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "> %s %s\n", req.Method, req.URL)
+	r.writeHeaders(&buf, "> ", req.Header)
+	if req.GetBody != nil {
+		if body, bodyErr := req.GetBody(); bodyErr == nil {
+			content, _ := ioutil.ReadAll(body)
+			_ = body.Close()
+			fmt.Fprintf(&buf, ">\n> %s\n", redactForm(content))
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(&buf, "< error: %v\n", err)
+	} else {
+		fmt.Fprintf(&buf, "< %d %s\n", res.StatusCode, http.StatusText(res.StatusCode))
+		r.writeHeaders(&buf, "< ", res.Header)
+		content, readErr := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize+1))
+		var rest io.Reader = res.Body
+		if readErr != nil {
+			rest = errReader{readErr}
+		}
+		res.Body = readCloser{io.MultiReader(bytes.NewReader(content), rest), res.Body}
+		if len(content) > maxErrorBodySize {
+			fmt.Fprintf(&buf, "<\n< %s\n< (truncated to %d bytes)\n", redactJSON(content[:maxErrorBodySize]), maxErrorBodySize)
+		} else {
+			fmt.Fprintf(&buf, "<\n< %s\n", redactJSON(content))
+		}
+	}
+	buf.WriteString("\n")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = r.w.Write(buf.Bytes())
+}
+
+// errReader is a reader always failing with err, or returning io.EOF if nil.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+// readCloser reads from the reader and closes the closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writeHeaders writes every value of the headers, one per line, redacting the
+// values of the redacted headers.
+func (r *requestRecorder) writeHeaders(buf *bytes.Buffer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if r.redactHeaders[http.CanonicalHeaderKey(name)] {
+				value = redacted
+			}
+			fmt.Fprintf(buf, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
+
+// redactForm redacts the sensitive fields of an encoded form.
+func redactForm(content []byte) string {
+	form, err := url.ParseQuery(string(content))
+	if err != nil {
+		return redacted
+	}
+	for _, field := range sensitiveFormFields {
+		if _, ok := form[field]; ok {
+			form.Set(field, redacted)
+		}
+	}
+	return form.Encode()
+}
+
+// redactJSON redacts the sensitive fields of a JSON object. Bodies that are
+// not JSON objects are written as they are.
+func redactJSON(content []byte) string {
+	var body map[string]interface{}
+	if err := json.Unmarshal(content, &body); err != nil || body == nil {
+		return string(content)
+	}
+	for _, field := range sensitiveResponseFields {
+		if _, ok := body[field]; ok {
+			body[field] = redacted
+		}
+	}
+	redactedContent, err := json.Marshal(body)
+	if err != nil {
+		return redacted
+	}
+	return string(redactedContent)
+}
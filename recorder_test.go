@@ -0,0 +1,105 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestRecorder(t *testing.T) {
+	tokenResponse := TokenResponse{
+		AccessToken:  "secret-access-token",
+		ExpiresIn:    3600,
+		IDToken:      "secret-id-token",
+		RefreshToken: "secret-refresh-token",
+		TokenType:    "Bearer",
+	}
+	tokenResponseBody, _ := json.Marshal(tokenResponse)
+	var dump bytes.Buffer
+	auth := appleAuth{
+		AppID:      "appID",
+		TeamID:     "teamID",
+		KeyID:      "keyID",
+		KeyContent: []byte{},
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(bytes.NewReader(tokenResponseBody)),
+			}, nil
+		}),
+		requestDecorator: func(req *http.Request) {
+			req.Header.Set("X-Gateway-Auth", "secret-gateway-credential")
+			req.Header.Add("X-Trace", "first")
+			req.Header.Add("X-Trace", "second")
+		},
+	}
+	now := time.Now()
+	auth.clock = func() time.Time { return now }
+	WithRequestRecorder(&dump, "x-gateway-auth")(&auth)
+
+	res, err := auth.validateCode(context.Background(), mockClientSecret, "secret-authorization-code")
+	assert.NoError(t, err)
+	assert.Equal(t, now, res.Clock())
+	res.Clock = nil
+	tokenResponse.ExpiresAt = now.Add(time.Hour)
+	tokenResponse.Header = http.Header{"Content-Type": []string{"application/json"}}
+	assert.Equal(t, &tokenResponse, res)
+
+	recorded := dump.String()
+	assert.Contains(t, recorded, "> POST "+validationEndpoint)
+	assert.Contains(t, recorded, "> Content-Type: application/x-www-form-urlencoded")
+	assert.Contains(t, recorded, "client_id=appID")
+	assert.Contains(t, recorded, "client_secret=REDACTED")
+	assert.Contains(t, recorded, "code=REDACTED")
+	assert.Contains(t, recorded, "> X-Gateway-Auth: REDACTED")
+	assert.Contains(t, recorded, "> X-Trace: first\n> X-Trace: second\n")
+	assert.Contains(t, recorded, "< 200 OK")
+	assert.Contains(t, recorded, `"token_type":"Bearer"`)
+	for _, secret := range []string{mockClientSecret, "secret-authorization-code", "secret-gateway-credential", "secret-access-token", "secret-id-token", "secret-refresh-token"} {
+		assert.NotContains(t, recorded, secret)
+	}
+}
+
+func TestRequestRecorder_Error(t *testing.T) {
+	var dump bytes.Buffer
+	auth := appleAuth{
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, assert.AnError
+		}),
+	}
+	WithRequestRecorder(&dump)(&auth)
+
+	_, err := auth.validateRefreshToken(context.Background(), mockClientSecret, "secret-refresh-token")
+	assert.Error(t, err)
+	assert.Contains(t, dump.String(), "< error: "+assert.AnError.Error())
+	assert.NotContains(t, dump.String(), "secret-refresh-token")
+}
+
+func TestRequestRecorder_LargeBody(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), maxErrorBodySize+10)
+	var dump bytes.Buffer
+	recorder := newRequestRecorder(&dump, nil)
+	req, err := http.NewRequest(http.MethodGet, keysEndpoint, nil)
+	assert.NoError(t, err)
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+
+	recorder.record(req, res, nil)
+	assert.Contains(t, dump.String(), "(truncated to 65536 bytes)")
+	assert.Less(t, dump.Len(), maxErrorBodySize+1024)
+	// The whole body is still read by the caller.
+	content, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, content)
+	assert.NoError(t, res.Body.Close())
+}
@@ -0,0 +1,109 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackoffBase = 100 * time.Millisecond
+	defaultBackoffMax  = 5 * time.Second
+)
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// DefaultBackoff is the exponential backoff with full jitter used between
+// retries: a random delay between zero and 100ms doubled at each attempt,
+// capped at 5 seconds. Attempts start at 1.
+func DefaultBackoff(attempt int) time.Duration {
+	ceiling := defaultBackoffMax
+	if attempt < 16 {
+		if exp := defaultBackoffBase << uint(attempt-1); exp < ceiling {
+			ceiling = exp
+		}
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(ceiling) + 1))
+}
+
+// isRetryable reports whether a failed request can be sent again: network
+// errors and 5xx responses are transient, other responses are not. Requests
+// that are not idempotent, such as authorization code exchanges, are only
+// retried when the connection to Apple could not be established, as the
+// request was then never sent.
+func isRetryable(req *http.Request, res *http.Response, err error, idempotent bool) bool {
+	switch {
+	case req.Context().Err() != nil || err == ErrCircuitOpen:
+		return false
+	case !idempotent:
+		return err != nil && isDialError(err)
+	case err != nil:
+		return true
+	default:
+		return res.StatusCode >= http.StatusInternalServerError
+	}
+}
+
+// isDialError reports whether the error happened while connecting to the
+// server, before anything was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryDelay returns the delay before the given retry attempt. It reports
+// false when the delay would go past the context deadline, in which case
+// retrying is pointless.
+func (a *appleAuth) retryDelay(ctx context.Context, attempt int) (time.Duration, bool) {
+	backoff := a.backoff
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
+	delay := backoff(attempt)
+	if delay < 0 {
+		delay = 0
+	}
+	// Context deadlines are set with the local clock, not the AppleAuth clock.
+	if deadline, ok := ctx.Deadline(); ok && delay >= time.Until(deadline) {
+		return 0, false
+	}
+	return delay, true
+}
+
+// rewindRequest returns a copy of the request with a fresh body, so it can be
+// sent again.
+func rewindRequest(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retryReq := req.Clone(req.Context())
+	retryReq.Body = body
+	return retryReq, true
+}
+
+// drainResponse discards a response that won't be returned to the caller.
+func drainResponse(res *http.Response) {
+	if res == nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxErrorBodySize))
+	_ = res.Body.Close()
+}
@@ -0,0 +1,148 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	var (
+		requests int
+		forms    []url.Values
+		backoffs []int
+	)
+	auth := appleAuth{
+		httpClient: httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			_ = req.ParseForm()
+			forms = append(forms, req.PostForm)
+			if requests < 3 {
+				return &http.Response{StatusCode: http.StatusBadGateway, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{}`)))}, nil
+		}),
+	}
+	WithMaxRetries(3)(&auth)
+	WithBackoff(func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	})(&auth)
+
+	form := make(url.Values)
+	form.Add("refresh_token", "refresh-token")
+	_, err := auth.validateRequest(context.Background(), form)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, []int{1, 2}, backoffs)
+	for _, sentForm := range forms {
+		assert.Equal(t, form, sentForm)
+	}
+}
+
+func TestRetry_NotRetryable(t *testing.T) {
+	server := &scriptedAppleServer{status: http.StatusBadRequest, body: `{"error":"invalid_grant"}`}
+	auth := appleAuth{httpClient: server}
+	WithMaxRetries(3)(&auth)
+	WithBackoff(func(int) time.Duration { return 0 })(&auth)
+
+	_, err := auth.validateRequest(context.Background(), make(url.Values))
+	assert.Equal(t, ErrorResponseInvalidGrant, err)
+	assert.Equal(t, 1, server.requests)
+}
+
+func TestRetry_Exhausted(t *testing.T) {
+	server := &scriptedAppleServer{err: assert.AnError}
+	auth := appleAuth{httpClient: server}
+	WithMaxRetries(2)(&auth)
+	WithBackoff(func(int) time.Duration { return 0 })(&auth)
+
+	_, err := auth.validateRequest(context.Background(), make(url.Values))
+	assert.True(t, errors.Is(err, assert.AnError), err)
+	assert.Equal(t, 3, server.requests)
+}
+
+func TestRetry_CodeExchange(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: validationEndpoint, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	tests := []struct {
+		name             string
+		server           *scriptedAppleServer
+		grantType        string
+		expectedRequests int
+	}{
+		{"code exchange network error after send", &scriptedAppleServer{err: assert.AnError}, GrantTypeAuthorizationCode, 1},
+		{"code exchange 5xx", &scriptedAppleServer{status: http.StatusBadGateway}, GrantTypeAuthorizationCode, 1},
+		{"code exchange dial error", &scriptedAppleServer{err: dialErr}, GrantTypeAuthorizationCode, 3},
+		{"refresh network error", &scriptedAppleServer{err: assert.AnError}, GrantTypeRefreshToken, 3},
+		{"refresh 5xx", &scriptedAppleServer{status: http.StatusBadGateway}, GrantTypeRefreshToken, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := appleAuth{httpClient: tt.server}
+			WithMaxRetries(2)(&auth)
+			WithBackoff(func(int) time.Duration { return 0 })(&auth)
+
+			form := make(url.Values)
+			form.Set("grant_type", tt.grantType)
+			_, err := auth.validateRequest(context.Background(), form)
+			assert.Error(t, err)
+			assert.Equal(t, tt.expectedRequests, tt.server.requests)
+		})
+	}
+}
+
+func TestRetry_DelayPastDeadline(t *testing.T) {
+	server := &scriptedAppleServer{status: http.StatusServiceUnavailable, body: `{"error":"unavailable"}`}
+	auth := appleAuth{httpClient: server}
+	WithMaxRetries(3)(&auth)
+	WithBackoff(func(int) time.Duration { return time.Hour })(&auth)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := auth.validateRequest(ctx, make(url.Values))
+	assert.Error(t, err)
+	assert.Equal(t, 1, server.requests)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRetry_DelayWithClockOffset(t *testing.T) {
+	auth := appleAuth{serverClock: &serverClock{}}
+	WithBackoff(func(int) time.Duration { return time.Second })(&auth)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Apple's clock ahead of the local one doesn't bring the deadline closer.
+	auth.serverClock.observe(time.Hour)
+	delay, ok := auth.retryDelay(ctx, 1)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	// Nor does a clock behind the local one push it away.
+	auth.serverClock = &serverClock{}
+	auth.serverClock.observe(-time.Hour)
+	WithBackoff(func(int) time.Duration { return 2 * time.Minute })(&auth)
+	_, ok = auth.retryDelay(ctx, 1)
+	assert.False(t, ok)
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 100; attempt++ {
+		ceiling := defaultBackoffMax
+		if attempt < 16 && defaultBackoffBase<<uint(attempt-1) < ceiling {
+			ceiling = defaultBackoffBase << uint(attempt-1)
+		}
+		for i := 0; i < 10; i++ {
+			delay := DefaultBackoff(attempt)
+			assert.True(t, delay >= 0 && delay <= ceiling, "attempt %d delay %s exceeds %s", attempt, delay, ceiling)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package apple
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serverClockWeight the weight of a new sample in the offset estimate. The
+// Date header has a one second resolution, averaging smooths it out.
+const serverClockWeight = 0.25
+
+// serverClock estimates the offset between Apple's clock and the local clock
+// from the Date headers of Apple's responses, as an exponential moving
+// average. See WithPreferServerTime.
+type serverClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+	known  bool
+}
+
+// observe adds an offset sample to the estimate.
+func (c *serverClock) observe(offset time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.known {
+		c.offset = offset
+		c.known = true
+		return
+	}
+	c.offset += time.Duration(serverClockWeight * float64(offset-c.offset))
+}
+
+// estimate returns the estimated offset, zero until a response was observed.
+func (c *serverClock) estimate() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// observeServerTime updates the server clock offset from the Date header of
+// the response, when WithPreferServerTime is enabled.
+func (a *appleAuth) observeServerTime(res *http.Response) {
+	if a.serverClock == nil || res == nil {
+		return
+	}
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	a.serverClock.observe(date.Sub(a.localNow()))
+}
@@ -0,0 +1,65 @@
+package apple
+
+import (
+	"context"
+	"crypto/rsa"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerClock(t *testing.T) {
+	var c serverClock
+	assert.Equal(t, time.Duration(0), c.estimate())
+	c.observe(-10 * time.Second)
+	assert.Equal(t, -10*time.Second, c.estimate())
+	c.observe(-6 * time.Second)
+	assert.Equal(t, -9*time.Second, c.estimate())
+}
+
+func TestWithPreferServerTime(t *testing.T) {
+	key := newTestRSAKey(t)
+	localNow := time.Unix(1600000000, 0)
+	// The local clock is 10 minutes ahead of Apple's.
+	appleNow := localNow.Add(-10 * time.Minute)
+	claims := newTestClaims()
+	claims["iat"] = appleNow.Add(-time.Minute).Unix()
+	claims["exp"] = appleNow.Add(5 * time.Minute).Unix()
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+	for name, preferServerTime := range map[string]bool{"enabled": true, "disabled": false} {
+		t.Run(name, func(t *testing.T) {
+			var opts []Option
+			if preferServerTime {
+				opts = append(opts, WithPreferServerTime())
+			}
+			auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t), opts...)
+			auth.clock = func() time.Time { return localNow }
+			apple := newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), nil)
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				res, err := apple.Do(req)
+				if err == nil {
+					res.Header = http.Header{"Date": {appleNow.Format(http.TimeFormat)}}
+				}
+				return res, err
+			})
+
+			// The keys are fetched from Apple, learning its clock.
+			_, err := auth.VerifyIDToken(context.Background(), idToken)
+			clientSecret, secretErr := auth.clientSecret(context.Background())
+			assert.NoError(t, secretErr)
+			token, decodeErr := decodeJWT(clientSecret)
+			assert.NoError(t, decodeErr)
+			iat, _ := numberClaim(token.claims, "iat")
+			if preferServerTime {
+				assert.NoError(t, err)
+				assert.Equal(t, appleNow.Unix(), iat)
+			} else {
+				assert.Equal(t, ErrTokenExpired, err)
+				assert.Equal(t, localNow.Unix(), iat)
+			}
+		})
+	}
+}
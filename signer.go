@@ -0,0 +1,71 @@
+package apple
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// signingMethodES256Signer signs tokens with ES256 using any crypto.Signer, so
+// client secrets can be signed by keys that never leave a KMS or an HSM.
+var signingMethodES256Signer jwt.SigningMethod = signerSigningMethod{}
+
+// signerSigningMethod is the jwt-go signing method of signingMethodES256Signer.
+type signerSigningMethod struct{}
+
+// Alg implements jwt.SigningMethod.
+func (signerSigningMethod) Alg() string {
+	return "ES256"
+}
+
+// Verify implements jwt.SigningMethod with the ES256 method of jwt-go.
+func (signerSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	return jwt.SigningMethodES256.Verify(signingString, signature, key)
+}
+
+// Sign implements jwt.SigningMethod. The key must be a crypto.Signer of an EC
+// P-256 key.
+func (signerSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	digest := sha256.Sum256([]byte(signingString))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	signature, err = jwsSignature(signature)
+	if err != nil {
+		return "", err
+	}
+	return jwt.EncodeSegment(signature), nil
+}
+
+// jwsSignature converts an ECDSA P-256 signature, ASN.1 encoded as returned by
+// crypto/ecdsa and most KMS, to the concatenation of r and s JWS requires.
+// Signatures already in that form are returned as is.
+func jwsSignature(signature []byte) ([]byte, error) {
+	if len(signature) == 64 {
+		return signature, nil
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 || sig.R.BitLen() > 256 || sig.S.BitLen() > 256 {
+		return nil, errors.New("invalid ECDSA P-256 signature")
+	}
+	out := make([]byte, 64)
+	sig.R.FillBytes(out[:32])
+	sig.S.FillBytes(out[32:])
+	return out, nil
+}
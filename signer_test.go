@@ -0,0 +1,142 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSigner is a crypto.Signer standing for a KMS key, counting signatures.
+type testSigner struct {
+	key   *ecdsa.PrivateKey
+	raw   bool
+	signs int
+}
+
+func (s *testSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *testSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.signs++
+	if !s.raw {
+		return s.key.Sign(rand, digest, opts)
+	}
+	r, sig, err := ecdsa.Sign(rand, s.key, digest)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 64)
+	r.FillBytes(out[:32])
+	sig.FillBytes(out[32:])
+	return out, nil
+}
+
+func TestNewWithSigner(t *testing.T) {
+	for name, raw := range map[string]bool{"ASN.1 signature": false, "raw signature": true} {
+		t.Run(name, func(t *testing.T) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer := &testSigner{key: key, raw: raw}
+			auth, err := NewWithSigner("appID", "teamID", "keyID", signer)
+			assert.NoError(t, err)
+
+			clientSecret, err := auth.(*appleAuth).clientSecret(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, signer.signs)
+
+			var claims jwt.StandardClaims
+			token, err := jwt.ParseWithClaims(clientSecret, &claims, func(token *jwt.Token) (interface{}, error) {
+				return &key.PublicKey, nil
+			})
+			assert.NoError(t, err)
+			assert.True(t, token.Valid)
+			assert.Equal(t, "ES256", token.Header["alg"])
+			assert.Equal(t, "keyID", token.Header["kid"])
+			assert.Equal(t, "appID", claims.Subject)
+
+			_, err = auth.KeyThumbprint()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateCode_SignsClientSecretOnce(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &testSigner{key: key}
+	auth, err := NewWithSigner("appID", "teamID", "keyID", signer)
+	assert.NoError(t, err)
+	tokenResponseBody, _ := json.Marshal(codeGrantResponse)
+	var clientSecrets []string
+	auth.(*appleAuth).httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		clientSecrets = append(clientSecrets, form.Get("client_secret"))
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(tokenResponseBody))}, nil
+	})
+
+	_, err = auth.ValidateCode("first-code")
+	assert.NoError(t, err)
+	_, err = auth.ValidateCode("second-code")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, signer.signs)
+	assert.Len(t, clientSecrets, 2)
+	assert.Equal(t, clientSecrets[0], clientSecrets[1])
+}
+
+func TestNewWithSigner_InvalidSigner(t *testing.T) {
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWithSigner("appID", "teamID", "keyID", p384Key)
+	assert.Equal(t, ErrUnsupportedCurve, err)
+
+	_, err = NewWithSigner("appID", "teamID", "keyID", newTestRSAKey(t))
+	assert.EqualError(t, err, "signer public key is not an EC key")
+
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWithSigner("appID", "teamID", "", p256Key)
+	assert.Equal(t, ErrKeyIDRequired, err)
+}
+
+func TestSetKey_ReplacesSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &testSigner{key: key}
+	auth, err := NewWithSigner("appID", "teamID", "keyID", signer)
+	assert.NoError(t, err)
+
+	assert.NoError(t, auth.SetKey("newKeyID", newTestKeyContent(t)))
+	_, err = auth.(*appleAuth).clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, signer.signs)
+}
@@ -0,0 +1,61 @@
+package apple
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ConfigSummary returns a human readable summary of the configuration, to
+// compare deployments when debugging environment specific issues. The key
+// material and the client secrets are never included, the key is identified
+// by its thumbprint only.
+func (a *appleAuth) ConfigSummary() string {
+	a.keyMu.RLock()
+	keyID := a.KeyID
+	a.keyMu.RUnlock()
+
+	var b strings.Builder
+	line := func(name string, value interface{}) {
+		fmt.Fprintf(&b, "%s: %v\n", name, value)
+	}
+	line("app id", a.AppID)
+	line("team id", a.TeamID)
+	line("key id", keyID)
+	if thumbprint, err := a.KeyThumbprint(); err == nil {
+		line("key thumbprint", thumbprint)
+	} else {
+		line("key thumbprint", "unavailable ("+err.Error()+")")
+	}
+	line("key", "redacted")
+	if len(a.clientIDs) > 0 {
+		line("client ids", strings.Join(a.clientIDs, ", "))
+	}
+	line("issuer", a.expectedIssuer())
+	line("token endpoint", a.tokenURL())
+	line("keys endpoint", keysEndpoint)
+	line("authorization endpoint", authorizationEndpoint)
+	if client, ok := a.httpClient.(*http.Client); ok {
+		line("request timeout", client.Timeout)
+	}
+	line("keys timeout", a.keysTimeout)
+	line("max retries", a.maxRetries)
+	line("circuit breaker", a.breaker != nil)
+	if a.semaphore != nil {
+		line("max concurrency", cap(a.semaphore))
+	}
+	if a.cache != nil {
+		line("cache", fmt.Sprintf("%T", a.cache))
+	}
+	line("keys cache ttl", keysCacheTTL)
+	line("client secret lifetime", a.clientSecretLifetime)
+	line("client secret cache ttl", a.clientSecretLifetime-a.clientSecretRenewWindow())
+	if a.verificationCache != nil {
+		line("verification cache size", a.verificationCache.size)
+	}
+	if a.maxTokenAge > 0 {
+		line("max token age", a.maxTokenAge)
+	}
+	line("prefer server time", a.serverClock != nil)
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package apple
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigSummary(t *testing.T) {
+	keyContent := newTestKeyContent(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", keyContent, WithClientIDs("com.example.web"), WithKeysTimeout(3*time.Second))
+	clientSecret, err := auth.clientSecret(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, err := auth.KeyThumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := auth.ConfigSummary()
+	assert.Contains(t, summary, "app id: appID\n")
+	assert.Contains(t, summary, "team id: teamID\n")
+	assert.Contains(t, summary, "key id: keyID\n")
+	assert.Contains(t, summary, "key thumbprint: "+thumbprint+"\n")
+	assert.Contains(t, summary, "client ids: com.example.web\n")
+	assert.Contains(t, summary, "keys endpoint: "+keysEndpoint+"\n")
+	assert.Contains(t, summary, "keys timeout: 3s\n")
+	assert.NotContains(t, summary, string(keyContent))
+	assert.NotContains(t, summary, "PRIVATE KEY")
+	assert.NotContains(t, summary, clientSecret)
+}
@@ -1,8 +1,6 @@
 package apple
 
-import (
-	"github.com/tideland/gorest/jwt"
-)
+import "encoding/json"
 
 var (
 	// RealUserStatusUnsupported unsupported, only works in iOS >= 14.
@@ -25,6 +23,10 @@ type AppleUser struct {
 	// Email Apple user email.
 	Email string `json:"email"`
 
+	// RawEmail the email exactly as sent by Apple. It is only set when the
+	// email is normalized with WithNormalizeEmail.
+	RawEmail string `json:"raw_email,omitempty"`
+
 	// EmailVerified whether the email is verified.
 	EmailVerified bool `json:"email_verified"`
 
@@ -34,17 +36,68 @@ type AppleUser struct {
 	// RealUserStatus an integer value that indicates whether the user appears
 	// to be a real person.
 	RealUserStatus RealUserStatus `json:"real_user_status"`
+
+	// NonceSupported whether the platform the user signed in with supports
+	// nonces. When false the id token carries no nonce, so checking the nonce
+	// with VerifyOptions.ExpectedNonce does not protect against replays.
+	NonceSupported bool `json:"nonce_supported,omitempty"`
+
+	// GivenName the given name of the user. It is not part of the id token,
+	// Apple sends it once, in the user parameter of the first authorization
+	// response. See MergeName.
+	GivenName string `json:"given_name,omitempty"`
+
+	// FamilyName the family name of the user, sent along with GivenName.
+	FamilyName string `json:"family_name,omitempty"`
 }
 
-// GetUserInfoFromIDToken retrieve the user info from the JWT id token.
+// MergeName fills the empty name fields of the user with the given names,
+// without overwriting the ones already set. Apple only sends the name on the
+// first authorization, so a stored user can be backfilled whenever a later
+// callback happens to include it, while empty values never clobber it.
+func (u *AppleUser) MergeName(givenName, familyName string) {
+	if u.GivenName == "" {
+		u.GivenName = givenName
+	}
+	if u.FamilyName == "" {
+		u.FamilyName = familyName
+	}
+}
+
+// CanReceiveDirectEmail reports whether the email of the user is their real
+// address. It is false when the user hid their email behind Apple private
+// relay, or shared no email at all.
+func (u *AppleUser) CanReceiveDirectEmail() bool {
+	return u.Email != "" && !u.IsPrivateEmail
+}
+
+// GetUserInfoFromIDToken retrieve the user info from the JWT id token. It does
+// not verify the id token, so it must only be used with tokens received
+// directly from Apple. Use VerifyAndGetUser for tokens received from clients.
 func GetUserInfoFromIDToken(idToken string) (*AppleUser, error) {
-	token, err := jwt.Decode(idToken)
+	token, err := decodeJWT(idToken)
 	if err != nil {
 		return nil, err
 	}
 
+	return AppleUserFromClaims(token.claims), nil
+}
+
+// DecodeClaimsInto unmarshals the claims of the JWT id token into v, a pointer
+// to a struct with json tags matching Apple's claims. As
+// GetUserInfoFromIDToken, it does not verify the id token, see
+// VerifyClaimsInto for the verifying variant.
+func DecodeClaimsInto(idToken string, v interface{}) error {
+	token, err := decodeJWT(idToken)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(token.payload, v)
+}
+
+// AppleUserFromClaims builds an AppleUser from the claims of an id token.
+func AppleUserFromClaims(claims map[string]interface{}) *AppleUser {
 	u := AppleUser{}
-	claims := token.Claims()
 	if sub, ok := claims["sub"].(string); ok {
 		u.UID = sub
 	}
@@ -53,37 +106,74 @@ func GetUserInfoFromIDToken(idToken string) (*AppleUser, error) {
 		u.Email = email
 	}
 
-	if emailVerified, ok := claims["email_verified"].(bool); ok {
+	if emailVerified, ok := boolClaim(claims, "email_verified"); ok {
 		u.EmailVerified = emailVerified
 	}
 
-	if isPrivateEmail, ok := claims["is_private_email"].(bool); ok {
+	if isPrivateEmail, ok := boolClaim(claims, "is_private_email"); ok {
 		u.IsPrivateEmail = isPrivateEmail
 	}
 
-	// As in JSON ints and floats are the same type, the number type, we must check if the number is
-	// either an int or a float, and convert it to the first if the later.
-	var (
-		realUserStatus int
-		ok             bool
-	)
-	if realUserStatus, ok = claims["real_user_status"].(int); !ok {
-		var realUserStatusFloat float64
-		if realUserStatusFloat, ok = claims["real_user_status"].(float64); ok {
-			realUserStatus = int(realUserStatusFloat)
-		}
+	if realUserStatus, ok := numberClaim(claims, "real_user_status"); ok {
+		u.RealUserStatus = realUserStatusFromInt(realUserStatus)
+	}
+
+	if nonceSupported, ok := boolClaim(claims, "nonce_supported"); ok {
+		u.NonceSupported = nonceSupported
+	}
+
+	return &u
+}
+
+// realUserStatusFromInt maps the real_user_status claim value to a RealUserStatus.
+func realUserStatusFromInt(realUserStatus int64) RealUserStatus {
+	switch realUserStatus {
+	case int64(RealUserStatusLikelyReal):
+		return RealUserStatusLikelyReal
+	case int64(RealUserStatusUnknown):
+		return RealUserStatusUnknown
+	default:
+		return RealUserStatusUnsupported
 	}
+}
 
-	if ok {
-		switch realUserStatus {
-		case int(RealUserStatusLikelyReal):
-			u.RealUserStatus = RealUserStatusLikelyReal
-		case int(RealUserStatusUnknown):
-			u.RealUserStatus = RealUserStatusUnknown
-		default:
-			u.RealUserStatus = RealUserStatusUnsupported
+// boolClaim reads a boolean claim. Apple sends some boolean claims either as
+// JSON booleans or as the strings "true" and "false", so both are accepted.
+func boolClaim(claims map[string]interface{}, name string) (bool, bool) {
+	switch v := claims[name].(type) {
+	case bool:
+		return v, true
+	case string:
+		switch v {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
 		}
 	}
+	return false, false
+}
 
-	return &u, nil
+// numberClaim reads a numeric claim. As in JSON ints and floats are the same type, the number
+// type, we must check if the number is either an int or a float, and convert it to the first if
+// the later. Claims decoded with UseNumber hold a json.Number instead.
+func numberClaim(claims map[string]interface{}, name string) (int64, bool) {
+	switch v := claims[name].(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, true
+		}
+		if f, err := v.Float64(); err == nil {
+			return int64(f), true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
 }
@@ -0,0 +1,123 @@
+package apple
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// verificationCache is a bounded LRU cache of verified id tokens, keyed by the
+// SHA-256 hash of the token, holding each entry until the token expires.
+type verificationCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[[sha256.Size]byte]*list.Element
+}
+
+type verificationCacheEntry struct {
+	key       [sha256.Size]byte
+	verified  *verifiedIDToken
+	expiresAt time.Time
+}
+
+func newVerificationCache(size int) *verificationCache {
+	return &verificationCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[[sha256.Size]byte]*list.Element, size),
+	}
+}
+
+// get returns a copy of the verified token cached for the key, unless it is
+// expired at now.
+func (c *verificationCache) get(key [sha256.Size]byte, now time.Time) (*verifiedIDToken, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*verificationCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	return entry.verified.copy(), true
+}
+
+// copy returns a copy of the verified token so callers can't alter cached
+// entries.
+func (v *verifiedIDToken) copy() *verifiedIDToken {
+	token, user, claims := *v.token, *v.user, *v.claims
+	token.claims = copyClaims(token.claims)
+	return &verifiedIDToken{
+		token:  &token,
+		claims: &claims,
+		user:   &user,
+	}
+}
+
+// copyClaims returns a deep copy of JSON decoded claims.
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	if claims == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		copied[name] = copyClaimValue(value)
+	}
+	return copied
+}
+
+// copyClaimValue returns a deep copy of a JSON decoded value.
+func copyClaimValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyClaims(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, element := range v {
+			copied[i] = copyClaimValue(element)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// add caches a copy of the verified token until expiresAt, evicting the least
+// recently used entry when the cache is full. Tokens already expired at now
+// are not cached.
+func (c *verificationCache) add(key [sha256.Size]byte, verified *verifiedIDToken, expiresAt, now time.Time) {
+	if !now.Before(expiresAt) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+	for c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+	}
+	c.items[key] = c.order.PushFront(&verificationCacheEntry{
+		key:       key,
+		verified:  verified.copy(),
+		expiresAt: expiresAt,
+	})
+}
+
+func (c *verificationCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*verificationCacheEntry).key)
+}
+
+func (c *verificationCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
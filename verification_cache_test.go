@@ -0,0 +1,111 @@
+package apple
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keySource counting how many times a key is looked up, that is how many signatures are verified.
+type countingKeySource struct {
+	staticKeySource
+	mu      sync.Mutex
+	lookups int
+}
+
+func (s *countingKeySource) keyFor(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	s.lookups++
+	s.mu.Unlock()
+	return s.staticKeySource.keyFor(ctx, kid)
+}
+
+func TestVerificationCache(t *testing.T) {
+	key := newTestRSAKey(t)
+	source := &countingKeySource{staticKeySource: staticKeySource{testKeyID: &key.PublicKey}}
+	now := time.Now()
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithVerificationCache(10))
+	auth.keySource = source
+	auth.clock = func() time.Time { return now }
+	claims := newTestClaims()
+	claims["nonce"] = "nonce"
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+	user, err := auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	user.Email = "changed@yourdomain"
+	user, err = auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "anemail@yourdomain", user.Email)
+	assert.Equal(t, 1, source.lookups)
+
+	// Options are checked on cache hits.
+	_, err = auth.VerifyIDTokenWithOptions(context.Background(), idToken, VerifyOptions{ExpectedNonce: "other-nonce"})
+	assert.Equal(t, ErrNonceMismatch, err)
+	assert.Equal(t, 1, source.lookups)
+
+	// A token is never served past its expiration.
+	now = now.Add(2 * time.Hour)
+	_, err = auth.VerifyIDToken(context.Background(), idToken)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Equal(t, 0, auth.verificationCache.len())
+}
+
+func TestVerificationCache_Bounded(t *testing.T) {
+	key := newTestRSAKey(t)
+	source := &countingKeySource{staticKeySource: staticKeySource{testKeyID: &key.PublicKey}}
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithVerificationCache(2))
+	auth.keySource = source
+
+	var idTokens []string
+	for i := 0; i < 3; i++ {
+		claims := newTestClaims()
+		claims["sub"] = strconv.Itoa(i)
+		idTokens = append(idTokens, signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims))
+	}
+	for _, idToken := range idTokens {
+		_, err := auth.VerifyIDToken(context.Background(), idToken)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, auth.verificationCache.len())
+
+	// The least recently used token was evicted.
+	_, err := auth.VerifyIDToken(context.Background(), idTokens[2])
+	assert.NoError(t, err)
+	assert.Equal(t, 3, source.lookups)
+	_, err = auth.VerifyIDToken(context.Background(), idTokens[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 4, source.lookups)
+}
+
+func TestVerificationCache_Concurrent(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithVerificationCache(5))
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := auth.VerifyIDToken(context.Background(), idToken)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, auth.verificationCache.len())
+}
+
+func TestVerificationCache_ExpiredNotAdded(t *testing.T) {
+	now := time.Now()
+	cache := newVerificationCache(1)
+	cache.add(sha256.Sum256([]byte("token")), &verifiedIDToken{}, now, now)
+	assert.Equal(t, 0, cache.len())
+}
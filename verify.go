@@ -0,0 +1,642 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// privateRelayDomain the domain of the addresses of users hiding their email.
+const privateRelayDomain = "privaterelay.appleid.com"
+
+// subjectPattern the format of the sub claim of Apple id tokens, for example
+// 001234.abcdef0123456789abcdef0123456789.0123.
+var subjectPattern = regexp.MustCompile(`^[0-9]+\.[0-9a-f]+\.[0-9]+$`)
+
+// IDTokenClaims the claims of an Apple id token.
+type IDTokenClaims struct {
+	// Issuer the issuer of the token, always https://appleid.apple.com.
+	Issuer string `json:"iss"`
+
+	// Subject the unique identifier of the user.
+	Subject string `json:"sub"`
+
+	// Audience the client id of the app the token was issued for.
+	Audience string `json:"aud"`
+
+	// IssuedAt the time, in seconds since epoch, the token was issued.
+	IssuedAt int64 `json:"iat"`
+
+	// ExpiresAt the time, in seconds since epoch, the token expires.
+	ExpiresAt int64 `json:"exp"`
+
+	// AuthTime the time, in seconds since epoch, the user authenticated.
+	AuthTime int64 `json:"auth_time"`
+
+	// Email the user email.
+	Email string `json:"email"`
+
+	// EmailVerified whether the email is verified.
+	EmailVerified bool `json:"email_verified"`
+
+	// IsPrivateEmail whether the email shared by the user is the proxy address.
+	IsPrivateEmail bool `json:"is_private_email"`
+
+	// RealUserStatus whether the user appears to be a real person.
+	RealUserStatus RealUserStatus `json:"real_user_status"`
+
+	// Nonce the nonce sent in the authorization request, if any.
+	Nonce string `json:"nonce"`
+
+	// NonceSupported whether the platform the user signed in supports nonces.
+	NonceSupported bool `json:"nonce_supported"`
+
+	// OrgID the identifier of the organization of a Managed Apple ID signing
+	// in with Sign in with Apple at Work & School. Empty for consumer tokens.
+	OrgID string `json:"org_id,omitempty"`
+
+	// AuthorizedParty the client id of the party the token was issued to, as
+	// per OpenID Connect. Apple does not send it at the time of writing.
+	AuthorizedParty string `json:"azp,omitempty"`
+}
+
+// VerifyOptions additional checks performed when verifying an id token.
+type VerifyOptions struct {
+	// ExpectedNonce when not empty, the id token must contain a nonce claim
+	// equal to it, regardless of the nonce_supported claim. A token without
+	// nonce fails with ErrNonceMissing and a token with another nonce fails
+	// with ErrNonceMismatch. See WithRequireNonceSupported for a lenient
+	// alternative.
+	ExpectedNonce string
+
+	// Code when not empty, the id token must contain a c_hash claim matching
+	// the authorization code, otherwise ErrInvalidCodeHash is returned. When
+	// empty the c_hash claim is not checked.
+	Code string
+
+	// AccessToken when not empty, the id token must contain an at_hash claim
+	// matching the access token, otherwise ErrInvalidAccessTokenHash is
+	// returned. When empty the at_hash claim is not checked.
+	AccessToken string
+}
+
+// ExchangeResult the result of exchanging an authorization code and verifying
+// the returned id token.
+type ExchangeResult struct {
+	// TokenResponse the tokens returned by Apple.
+	TokenResponse *TokenResponse
+
+	// User the user of the verified id token.
+	User *AppleUser
+
+	// Claims the claims of the verified id token.
+	Claims *IDTokenClaims
+
+	// RawClaims all the claims of the verified id token, including the ones
+	// not mapped in Claims.
+	RawClaims map[string]interface{}
+}
+
+// VerifiedIDToken the details of a verified id token.
+type VerifiedIDToken struct {
+	// User the user identified by the id token.
+	User *AppleUser
+
+	// Claims the claims of the id token.
+	Claims *IDTokenClaims
+
+	// KeyID the id of the Apple key that signed the id token.
+	KeyID string
+
+	// Algorithm the algorithm the id token was signed with.
+	Algorithm string
+
+	// Payload the decoded payload of the id token, the exact JSON bytes
+	// signed by Apple, including claim order and unknown claims.
+	Payload []byte
+}
+
+// SessionClaims returns the durable identity of the user, ready to be signed
+// into the application's own session token: sub, email, email_verified,
+// is_private_email, given_name and family_name. Transient claims such as the
+// token expiration or the nonce are left out. The email claims are omitted
+// when the user did not share an email, the name claims when the name is
+// unknown, which is the case until MergeName is called with the name Apple
+// sends on the first sign in. The result is empty for a partial result
+// without user.
+func (r *ExchangeResult) SessionClaims() map[string]interface{} {
+	claims := make(map[string]interface{})
+	if r.User == nil {
+		return claims
+	}
+	claims["sub"] = r.User.UID
+	if r.User.Email != "" {
+		claims["email"] = r.User.Email
+		claims["email_verified"] = r.User.EmailVerified
+		claims["is_private_email"] = r.User.IsPrivateEmail
+	}
+	if r.User.GivenName != "" {
+		claims["given_name"] = r.User.GivenName
+	}
+	if r.User.FamilyName != "" {
+		claims["family_name"] = r.User.FamilyName
+	}
+	return claims
+}
+
+// verifiedIDToken an id token whose signature and standard claims were verified.
+type verifiedIDToken struct {
+	token  *jwtToken
+	claims *IDTokenClaims
+	user   *AppleUser
+}
+
+// claimsFromMap builds the IDTokenClaims from the decoded claims of an id token.
+func claimsFromMap(claims map[string]interface{}) *IDTokenClaims {
+	u := AppleUserFromClaims(claims)
+	c := IDTokenClaims{
+		Subject:        u.UID,
+		Email:          u.Email,
+		EmailVerified:  u.EmailVerified,
+		IsPrivateEmail: u.IsPrivateEmail,
+		RealUserStatus: u.RealUserStatus,
+	}
+	if iss, ok := claims["iss"].(string); ok {
+		c.Issuer = iss
+	}
+	if aud, ok := claims["aud"].(string); ok {
+		c.Audience = aud
+	}
+	c.IssuedAt, _ = numberClaim(claims, "iat")
+	c.ExpiresAt, _ = numberClaim(claims, "exp")
+	c.AuthTime, _ = numberClaim(claims, "auth_time")
+	if nonce, ok := claims["nonce"].(string); ok {
+		c.Nonce = nonce
+	}
+	c.NonceSupported, _ = boolClaim(claims, "nonce_supported")
+	if orgID, ok := claims["org_id"].(string); ok {
+		c.OrgID = orgID
+	}
+	if azp, ok := claims["azp"].(string); ok {
+		c.AuthorizedParty = azp
+	}
+	return &c
+}
+
+// GetClaimsFromIDToken retrieve the claims from the JWT id token, including
+// nonce and nonce_supported, for callers implementing their own checks. As
+// GetUserInfoFromIDToken, it does not verify the id token, see VerifyIDToken.
+func GetClaimsFromIDToken(idToken string) (*IDTokenClaims, error) {
+	token, err := decodeJWT(idToken)
+	if err != nil {
+		return nil, err
+	}
+	return claimsFromMap(token.claims), nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array of strings,
+// contains the given audience.
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAudience reports whether the aud claim contains the app id or one of the
+// client ids added with WithClientIDs.
+func (a *appleAuth) hasAudience(claims map[string]interface{}) bool {
+	if hasAudience(claims, a.AppID) {
+		return true
+	}
+	for _, clientID := range a.clientIDs {
+		if hasAudience(claims, clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// userFromClaims builds an AppleUser from the claims of an id token applying
+// the configured email normalization.
+func (a *appleAuth) userFromClaims(claims map[string]interface{}) *AppleUser {
+	u := AppleUserFromClaims(claims)
+	if email, ok := a.customEmail(claims); ok {
+		u.Email = email
+	}
+	if a.normalizeEmail && u.Email != "" {
+		u.RawEmail = u.Email
+		u.Email = a.normalizedEmail(u.Email)
+	}
+	return u
+}
+
+// normalizedEmail returns the email lowercased and, with WithStripRelayDots,
+// without the dots of the local part of private relay addresses.
+func (a *appleAuth) normalizedEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !a.stripRelayDots {
+		return email
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 || email[at+1:] != privateRelayDomain {
+		return email
+	}
+	return strings.ReplaceAll(email[:at], ".", "") + email[at:]
+}
+
+// customEmail returns the email of the claims read from the claim set with
+// WithEmailClaimName, and false when the email is read from the email claim.
+func (a *appleAuth) customEmail(claims map[string]interface{}) (string, bool) {
+	if a.emailClaimName == "" {
+		return "", false
+	}
+	email, _ := claims[a.emailClaimName].(string)
+	return email, true
+}
+
+// expectedIssuer returns the issuer id tokens must have, Apple unless
+// overridden.
+func (a *appleAuth) expectedIssuer() string {
+	if a.issuer != "" {
+		return a.issuer
+	}
+	return appleAudience
+}
+
+// issuerMatches reports whether the issuer is the expected one. Trailing
+// slashes are ignored on both sides, as some tooling appends one to urls.
+func (a *appleAuth) issuerMatches(issuer string) bool {
+	return strings.TrimRight(issuer, "/") == strings.TrimRight(a.expectedIssuer(), "/")
+}
+
+func (a *appleAuth) now() time.Time {
+	if a.serverClock != nil {
+		return a.localNow().Add(a.serverClock.estimate())
+	}
+	return a.localNow()
+}
+
+// localNow returns the time of the local clock, ignoring the server clock
+// offset.
+func (a *appleAuth) localNow() time.Time {
+	if a.clock != nil {
+		return a.clock()
+	}
+	return time.Now()
+}
+
+// VerifyAndGetUser verifies the id token and returns the user it identifies.
+// It is the verifying counterpart of GetUserInfoFromIDToken and the method to
+// use with id tokens received from clients: Apple's public keys are fetched
+// with ctx, the signature is verified and the issuer, audience and expiration
+// are validated. It is equivalent to VerifyIDToken.
+func (a *appleAuth) VerifyAndGetUser(ctx context.Context, idToken string) (*AppleUser, error) {
+	return a.VerifyIDToken(ctx, idToken)
+}
+
+// VerifyIDToken verifies the id token signature against Apple's public keys,
+// validates its issuer, audience and expiration and returns the user it
+// identifies. Unlike GetUserInfoFromIDToken it is safe to use with tokens
+// received from untrusted clients.
+func (a *appleAuth) VerifyIDToken(ctx context.Context, idToken string) (*AppleUser, error) {
+	return a.VerifyIDTokenWithOptions(ctx, idToken, VerifyOptions{})
+}
+
+// bearerScheme the prefix of Authorization header values carrying a token.
+const bearerScheme = "bearer "
+
+// VerifyBearer verifies the id token of an Authorization header value, such as
+// "Bearer <id token>", as VerifyIDToken does. The scheme is matched case
+// insensitively and ErrInvalidAuthorizationHeader is returned when it is
+// missing or not followed by a token.
+func (a *appleAuth) VerifyBearer(ctx context.Context, authHeader string) (*AppleUser, error) {
+	authHeader = strings.TrimSpace(authHeader)
+	if len(authHeader) < len(bearerScheme) || !strings.EqualFold(authHeader[:len(bearerScheme)], bearerScheme) {
+		return nil, ErrInvalidAuthorizationHeader
+	}
+	idToken := strings.TrimSpace(authHeader[len(bearerScheme):])
+	if idToken == "" {
+		return nil, ErrInvalidAuthorizationHeader
+	}
+	return a.VerifyIDToken(ctx, idToken)
+}
+
+// VerifyIDTokenWithKeys verifies the id token against the given JSON Web Key
+// Set, as served by Apple keys endpoint, with the same checks as VerifyIDToken
+// but without network access nor cache. The token audience must contain
+// expectedAud, the client id, and its issuer must be expectedIss, Apple when
+// empty. It suits short lived functions that fetch the keys themselves.
+func VerifyIDTokenWithKeys(idToken string, jwks []byte, expectedAud, expectedIss string) (*AppleUser, error) {
+	keys, err := decodeKeySet(bytes.NewReader(jwks))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key set: %w", err)
+	}
+	a := &appleAuth{
+		AppID:     expectedAud,
+		keySource: staticKeySource(keys),
+		issuer:    expectedIss,
+	}
+	return a.VerifyIDToken(context.Background(), idToken)
+}
+
+// UserFromIDToken returns the user of an id token received directly from
+// Apple token endpoint, such as TokenResponse.IDToken, after checking its
+// issuer is Apple, its audience is the app and it did not expire. Errors wrap
+// ErrInvalidIssuer, ErrInvalidAudience and ErrTokenExpired. As
+// GetUserInfoFromIDToken, it does not verify the signature, so tokens received
+// from clients must be verified with VerifyIDToken instead.
+func (a *appleAuth) UserFromIDToken(idToken string) (*AppleUser, error) {
+	token, err := decodeJWT(idToken)
+	if err != nil {
+		return nil, err
+	}
+	claims := claimsFromMap(token.claims)
+	if !a.issuerMatches(claims.Issuer) {
+		return nil, fmt.Errorf("%w: iss is %q, want %q", ErrInvalidIssuer, claims.Issuer, a.expectedIssuer())
+	}
+	if !a.hasAudience(token.claims) {
+		return nil, fmt.Errorf("%w: aud is %v, want %q", ErrInvalidAudience, token.claims["aud"], a.AppID)
+	}
+	if expiresAt := time.Unix(claims.ExpiresAt, 0); !a.now().Before(expiresAt) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrTokenExpired, expiresAt.UTC().Format(time.RFC3339))
+	}
+	return a.userFromClaims(token.claims), nil
+}
+
+// VerifyIDTokenWithOptions verifies the id token as VerifyIDToken does and
+// performs the additional checks of opts.
+func (a *appleAuth) VerifyIDTokenWithOptions(ctx context.Context, idToken string, opts VerifyOptions) (*AppleUser, error) {
+	verified, err := a.verifyIDToken(ctx, idToken, opts)
+	if err != nil {
+		return nil, err
+	}
+	return verified.user, nil
+}
+
+// VerifyIDTokenDetailed verifies the id token as VerifyIDToken does and returns
+// it with the key id and algorithm of its signature and its raw payload, for
+// callers storing or re-signing the exact claims.
+func (a *appleAuth) VerifyIDTokenDetailed(ctx context.Context, idToken string) (*VerifiedIDToken, error) {
+	verified, err := a.verifyIDToken(ctx, idToken, VerifyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	claims := *verified.claims
+	return &VerifiedIDToken{
+		User:      verified.user,
+		Claims:    &claims,
+		KeyID:     verified.token.header.KeyID,
+		Algorithm: verified.token.header.Algorithm,
+		Payload:   append([]byte(nil), verified.token.payload...),
+	}, nil
+}
+
+// VerifyClaimsInto verifies the id token as VerifyIDToken does and unmarshals
+// its claims into v, a pointer to a struct with json tags matching Apple's
+// claims.
+func (a *appleAuth) VerifyClaimsInto(ctx context.Context, idToken string, v interface{}) error {
+	verified, err := a.verifyIDToken(ctx, idToken, VerifyOptions{})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(verified.token.payload, v)
+}
+
+func (a *appleAuth) verifyIDToken(ctx context.Context, idToken string, opts VerifyOptions) (*verifiedIDToken, error) {
+	verified, err := a.checkIDToken(ctx, idToken, opts)
+	a.logVerification(idToken, err)
+	a.recordVerification(err)
+	return verified, err
+}
+
+func (a *appleAuth) checkIDToken(ctx context.Context, idToken string, opts VerifyOptions) (*verifiedIDToken, error) {
+	verified, err := a.verifySignedClaims(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	token, claims := verified.token, verified.claims
+	if !a.now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrTokenExpired
+	}
+	if a.maxTokenAge > 0 && a.now().Sub(time.Unix(claims.IssuedAt, 0)) > a.maxTokenAge {
+		return nil, ErrTokenTooOld
+	}
+	if err := a.verifyNonce(token.claims, opts.ExpectedNonce); err != nil {
+		return nil, err
+	}
+	if opts.Code != "" && !verifyTokenHash(token.claims, "c_hash", opts.Code) {
+		return nil, ErrInvalidCodeHash
+	}
+	if opts.AccessToken != "" && !verifyTokenHash(token.claims, "at_hash", opts.AccessToken) {
+		return nil, ErrInvalidAccessTokenHash
+	}
+	return verified, nil
+}
+
+// verifySignedClaims verifies the signature, issuer and audience of the id
+// token, which don't depend on time nor on the verify options, so the result
+// can be kept in the verification cache.
+func (a *appleAuth) verifySignedClaims(ctx context.Context, idToken string) (*verifiedIDToken, error) {
+	if err := a.checkOpen(); err != nil {
+		return nil, err
+	}
+	var cacheKey [sha256.Size]byte
+	if a.verificationCache != nil {
+		cacheKey = sha256.Sum256([]byte(idToken))
+		if verified, ok := a.verificationCache.get(cacheKey, a.now()); ok {
+			return verified, nil
+		}
+	}
+
+	token, err := decodeJWT(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verifySignature(ctx, token); err != nil {
+		return nil, err
+	}
+
+	claims := claimsFromMap(token.claims)
+	if email, ok := a.customEmail(token.claims); ok {
+		claims.Email = email
+	}
+	if a.normalizeEmail && claims.Email != "" {
+		claims.Email = a.normalizedEmail(claims.Email)
+	}
+	if !a.issuerMatches(claims.Issuer) {
+		return nil, ErrInvalidIssuer
+	}
+	if !a.hasAudience(token.claims) {
+		return nil, ErrInvalidAudience
+	}
+	if claims.AuthorizedParty != "" && !a.hasClientID(claims.AuthorizedParty) {
+		return nil, ErrInvalidAuthorizedParty
+	}
+	if a.validateSubjectFormat && !subjectPattern.MatchString(claims.Subject) {
+		return nil, ErrInvalidSubject
+	}
+	if a.allowedEmailDomains != nil && !a.emailDomainAllowed(claims) {
+		return nil, ErrEmailDomainNotAllowed
+	}
+	if !a.realUserStatusAllowed(claims.RealUserStatus) {
+		return nil, ErrRealUserStatusTooLow
+	}
+
+	verified := &verifiedIDToken{
+		token:  token,
+		claims: claims,
+		user:   a.userFromClaims(token.claims),
+	}
+	if a.verificationCache != nil {
+		a.verificationCache.add(cacheKey, verified, time.Unix(claims.ExpiresAt, 0), a.now())
+	}
+	return verified, nil
+}
+
+// realUserStatusAllowed reports whether the real user status meets the minimum
+// set with WithMinRealUserStatus.
+func (a *appleAuth) realUserStatusAllowed(status RealUserStatus) bool {
+	if status == RealUserStatusUnsupported && a.allowUnsupportedRealUserStatus {
+		return true
+	}
+	return status >= a.minRealUserStatus
+}
+
+// emailDomainAllowed reports whether the email of the claims is a private
+// relay address or belongs to one of the allowed domains.
+func (a *appleAuth) emailDomainAllowed(claims *IDTokenClaims) bool {
+	if claims.IsPrivateEmail {
+		return true
+	}
+	at := strings.LastIndex(claims.Email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(claims.Email[at+1:])
+	return domain == privateRelayDomain || a.allowedEmailDomains[domain]
+}
+
+// verifySignature verifies the token signature with the Apple key matching its
+// key id. As per the JOSE specification, a token without key id is verified
+// against every key of its algorithm, failing with ErrMissingKeyID when none
+// of several keys matches, ErrNoMatchingKey when the only key does not match
+// and ErrUnsupportedAlgorithm when there is no key of its algorithm.
+func (a *appleAuth) verifySignature(ctx context.Context, token *jwtToken) error {
+	if token.header.KeyID != "" {
+		key, err := a.keySource.keyFor(ctx, token.header.KeyID)
+		if err != nil {
+			return err
+		}
+		return token.verifySignature(key)
+	}
+
+	keys, err := a.keySource.keys(ctx)
+	if err != nil {
+		return err
+	}
+	candidates := 0
+	for _, key := range keys {
+		switch err := token.verifySignature(key); err {
+		case nil:
+			return nil
+		case ErrUnsupportedAlgorithm:
+			// The key is for another algorithm.
+		default:
+			candidates++
+		}
+	}
+	switch candidates {
+	case 0:
+		return ErrUnsupportedAlgorithm
+	case 1:
+		return ErrNoMatchingKey
+	default:
+		return ErrMissingKeyID
+	}
+}
+
+// verifyNonce checks the nonce claim against the expected nonce. The
+// comparison is made in constant time.
+func (a *appleAuth) verifyNonce(claims map[string]interface{}, expectedNonce string) error {
+	if expectedNonce == "" {
+		return nil
+	}
+	nonce, ok := claims["nonce"].(string)
+	if !ok {
+		if nonceSupported, _ := boolClaim(claims, "nonce_supported"); a.requireNonceSupported && !nonceSupported {
+			return nil
+		}
+		return ErrNonceMissing
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(expectedNonce)) != 1 {
+		return ErrNonceMismatch
+	}
+	return nil
+}
+
+// verifyTokenHash checks a c_hash or at_hash claim, the base64url encoding of
+// the left half of the SHA-256 hash of the value, as defined by OpenID Connect.
+func verifyTokenHash(claims map[string]interface{}, name, value string) bool {
+	claimHash, ok := claims[name].(string)
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(value))
+	expectedHash := base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+	return subtle.ConstantTimeCompare([]byte(claimHash), []byte(expectedHash)) == 1
+}
+
+// ValidateCodeFull validates an authorization code, with a redirect uri when
+// not empty, verifies the returned id token and returns the tokens along with
+// the verified user and claims.
+//
+// When the code exchange succeeds but the id token verification fails, both a
+// partial ExchangeResult, holding only the TokenResponse, and a
+// *PartialExchangeError are returned, so callers can still store the refresh
+// token. In any other failure the result is nil.
+func (a *appleAuth) ValidateCodeFull(ctx context.Context, code, redirectURI string) (*ExchangeResult, error) {
+	clientSecret, err := a.clientSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResponse *TokenResponse
+	if redirectURI == "" {
+		tokenResponse, err = a.validateCode(ctx, clientSecret, code)
+	} else {
+		tokenResponse, err = a.validateCodeWithRedirectURI(ctx, clientSecret, code, redirectURI)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	verified, err := a.verifyIDToken(ctx, tokenResponse.IDToken, VerifyOptions{})
+	if err != nil {
+		return &ExchangeResult{TokenResponse: tokenResponse}, &PartialExchangeError{
+			TokenResponse: tokenResponse,
+			Err:           err,
+		}
+	}
+	return &ExchangeResult{
+		TokenResponse: tokenResponse,
+		User:          verified.user,
+		Claims:        verified.claims,
+		RawClaims:     copyClaims(verified.token.claims),
+	}, nil
+}
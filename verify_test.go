@@ -0,0 +1,916 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKeyID = "test-kid"
+
+// Generates a new RSA key to sign id tokens in tests.
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Generates the PEM encoded PKCS8 content of a new EC P-256 key, as in an Apple .p8 file.
+func newTestKeyContent(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Builds a JWKS document with the public part of the given keys indexed by key id.
+func newTestJWKS(keys map[string]*rsa.PrivateKey) []byte {
+	var keySet jsonWebKeySet
+	for kid, key := range keys {
+		keySet.Keys = append(keySet.Keys, jsonWebKey{
+			KeyType:   "RSA",
+			KeyID:     kid,
+			Use:       "sig",
+			Algorithm: "RS256",
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	body, _ := json.Marshal(keySet)
+	return body
+}
+
+// Signs the claims with RS256 producing a compact JWT with the given header.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	headerBytes, _ := json.Marshal(header)
+	claimsBytes, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes)
+	hashed := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Returns valid id token claims for the appID audience.
+func newTestClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":              appleAudience,
+		"aud":              "appID",
+		"sub":              "001234.abcdef0123456789.0123",
+		"iat":              now.Unix(),
+		"exp":              now.Add(time.Hour).Unix(),
+		"email":            "anemail@yourdomain",
+		"email_verified":   true,
+		"is_private_email": false,
+		"real_user_status": 2,
+	}
+}
+
+// Returns an HTTP client serving the JWKS on the keys endpoint and the token response on the
+// token endpoint.
+func newTestAppleServer(jwks []byte, tokenResponse *TokenResponse) httpClient {
+	return httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		var body []byte
+		switch req.URL.String() {
+		case keysEndpoint:
+			body = jwks
+		case validationEndpoint:
+			body, _ = json.Marshal(tokenResponse)
+		default:
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+}
+
+func newTestVerifier(t *testing.T, jwks []byte) *appleAuth {
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = newTestAppleServer(jwks, nil)
+	return auth
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newTestVerifier(t, newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}))
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+
+	user, err := auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, &AppleUser{
+		UID:            "001234.abcdef0123456789.0123",
+		Email:          "anemail@yourdomain",
+		EmailVerified:  true,
+		RealUserStatus: RealUserStatusLikelyReal,
+	}, user)
+}
+
+func TestVerifyIDToken_Invalid(t *testing.T) {
+	key := newTestRSAKey(t)
+	otherKey := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := newTestClaims()
+		claims[name] = value
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		idToken string
+		err     error
+	}{
+		{"forged signature", signTestToken(t, otherKey, header, newTestClaims()), ErrInvalidSignature},
+		{"unknown kid", signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "unknown"}, newTestClaims()), ErrKeyNotFound},
+		{"symmetric algorithm", signTestToken(t, key, map[string]interface{}{"alg": "HS256", "kid": testKeyID}, newTestClaims()), ErrUnsupportedAlgorithm},
+		{"wrong issuer", signTestToken(t, key, header, withClaim("iss", "https://evil.example.com")), ErrInvalidIssuer},
+		{"wrong audience", signTestToken(t, key, header, withClaim("aud", "anotherAppID")), ErrInvalidAudience},
+		{"expired", signTestToken(t, key, header, withClaim("exp", time.Now().Add(-time.Minute).Unix())), ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newTestVerifier(t, newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}))
+			_, err := auth.VerifyIDToken(context.Background(), tt.idToken)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestVerifyIDToken_CachesKeys(t *testing.T) {
+	key := newTestRSAKey(t)
+	apple := newTestAppleServer(newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}), nil)
+	keyFetches := 0
+	auth := newAppleAuth("appID", "teamID", "keyID", newTestKeyContent(t))
+	auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() == keysEndpoint {
+			keyFetches++
+		}
+		return apple.Do(req)
+	})
+
+	for _, sub := range []string{"001234.abcdef0123456789.0123", "005678.abcdef0123456789.0123"} {
+		claims := newTestClaims()
+		claims["sub"] = sub
+		user, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims))
+		assert.NoError(t, err)
+		assert.Equal(t, sub, user.UID)
+	}
+	assert.Equal(t, 1, keyFetches)
+}
+
+func TestVerifyIDToken_MinRealUserStatus(t *testing.T) {
+	key := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	tests := []struct {
+		name   string
+		opts   []Option
+		status RealUserStatus
+		err    error
+	}{
+		{"default unsupported", nil, RealUserStatusUnsupported, nil},
+		{"likely real required, likely real", []Option{WithMinRealUserStatus(RealUserStatusLikelyReal)}, RealUserStatusLikelyReal, nil},
+		{"likely real required, unknown", []Option{WithMinRealUserStatus(RealUserStatusLikelyReal)}, RealUserStatusUnknown, ErrRealUserStatusTooLow},
+		{"likely real required, unsupported", []Option{WithMinRealUserStatus(RealUserStatusLikelyReal)}, RealUserStatusUnsupported, ErrRealUserStatusTooLow},
+		{"likely real required, unsupported allowed", []Option{WithMinRealUserStatus(RealUserStatusLikelyReal), WithAllowUnsupportedRealUserStatus()}, RealUserStatusUnsupported, nil},
+		{"unsupported allowed, unknown", []Option{WithMinRealUserStatus(RealUserStatusLikelyReal), WithAllowUnsupportedRealUserStatus()}, RealUserStatusUnknown, ErrRealUserStatusTooLow},
+		{"unknown required, unknown", []Option{WithMinRealUserStatus(RealUserStatusUnknown)}, RealUserStatusUnknown, nil},
+		{"unknown required, unsupported", []Option{WithMinRealUserStatus(RealUserStatusUnknown)}, RealUserStatusUnsupported, ErrRealUserStatusTooLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", nil, tt.opts...)
+			auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+			claims := newTestClaims()
+			claims["real_user_status"] = int(tt.status)
+			_, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, header, claims))
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestVerifyIDToken_AuthorizedParty(t *testing.T) {
+	key := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	tests := []struct {
+		name string
+		azp  interface{}
+		err  error
+	}{
+		{"absent", nil, nil},
+		{"app id", "appID", nil},
+		{"other client id", "com.example.web", nil},
+		{"unknown party", "com.evil.app", ErrInvalidAuthorizedParty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", nil, WithClientIDs("com.example.web"))
+			auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+			claims := newTestClaims()
+			if tt.azp != nil {
+				claims["azp"] = tt.azp
+			}
+			verified, err := auth.VerifyIDTokenDetailed(context.Background(), signTestToken(t, key, header, claims))
+			assert.Equal(t, tt.err, err)
+			if err == nil && tt.azp != nil {
+				assert.Equal(t, tt.azp, verified.Claims.AuthorizedParty)
+			}
+		})
+	}
+}
+
+func TestVerifyIDToken_IssuerTrailingSlash(t *testing.T) {
+	key := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	tests := []struct {
+		name     string
+		issuer   string
+		expected string
+		err      error
+	}{
+		{"exact", "https://appleid.apple.com", "", nil},
+		{"token with trailing slash", "https://appleid.apple.com/", "", nil},
+		{"expected with trailing slash", "https://appleid.apple.com", "https://appleid.apple.com/", nil},
+		{"different issuer", "https://appleid.apple.com.evil.example.com/", "", ErrInvalidIssuer},
+		{"issuer with path", "https://appleid.apple.com/auth", "", ErrInvalidIssuer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", nil)
+			auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+			auth.issuer = tt.expected
+			claims := newTestClaims()
+			claims["iss"] = tt.issuer
+			_, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, header, claims))
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestValidateCodeFull(t *testing.T) {
+	key := newTestRSAKey(t)
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+	auth := newTestVerifier(t, nil)
+	auth.httpClient = newTestAppleServer(
+		newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}),
+		&TokenResponse{IDToken: idToken, RefreshToken: "refresh-token", TokenType: "Bearer"},
+	)
+
+	res, err := auth.ValidateCodeFull(context.Background(), "apple-authorization-code", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh-token", res.TokenResponse.RefreshToken)
+	assert.Equal(t, "001234.abcdef0123456789.0123", res.User.UID)
+	assert.Equal(t, appleAudience, res.Claims.Issuer)
+	assert.Equal(t, "appID", res.Claims.Audience)
+	assert.Equal(t, "anemail@yourdomain", res.RawClaims["email"])
+}
+
+func TestValidateCodeFull_RawClaimsCopied(t *testing.T) {
+	key := newTestRSAKey(t)
+	claims := newTestClaims()
+	claims["custom"] = map[string]interface{}{"roles": []interface{}{"admin"}}
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+	auth := newTestVerifier(t, nil)
+	WithVerificationCache(10)(auth)
+	auth.httpClient = newTestAppleServer(
+		newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}),
+		&TokenResponse{IDToken: idToken, RefreshToken: "refresh-token", TokenType: "Bearer"},
+	)
+
+	res, err := auth.ValidateCodeFull(context.Background(), "apple-authorization-code", "")
+	assert.NoError(t, err)
+	res.RawClaims["email"] = "changed@yourdomain"
+	res.RawClaims["custom"].(map[string]interface{})["roles"].([]interface{})[0] = "changed"
+
+	// The cached verification is not altered by the caller.
+	res, err = auth.ValidateCodeFull(context.Background(), "apple-authorization-code", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "anemail@yourdomain", res.RawClaims["email"])
+	assert.Equal(t, map[string]interface{}{"roles": []interface{}{"admin"}}, res.RawClaims["custom"])
+}
+
+func TestVerifyIDTokenWithOptions_ExpectedNonce(t *testing.T) {
+	key := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key})
+
+	withNonce := func(nonce interface{}, nonceSupported interface{}) string {
+		claims := newTestClaims()
+		if nonce != nil {
+			claims["nonce"] = nonce
+		}
+		if nonceSupported != nil {
+			claims["nonce_supported"] = nonceSupported
+		}
+		return signTestToken(t, key, header, claims)
+	}
+
+	tests := []struct {
+		name                  string
+		idToken               string
+		requireNonceSupported bool
+		err                   error
+	}{
+		{"matching nonce", withNonce("nonce", true), false, nil},
+		{"mismatching nonce", withNonce("other-nonce", true), false, ErrNonceMismatch},
+		{"missing nonce", withNonce(nil, nil), false, ErrNonceMissing},
+		{"missing nonce when supported", withNonce(nil, true), false, ErrNonceMissing},
+		{"missing nonce when unsupported", withNonce(nil, false), false, ErrNonceMissing},
+		{"lenient missing nonce when unsupported", withNonce(nil, false), true, nil},
+		{"lenient missing nonce without nonce_supported", withNonce(nil, nil), true, nil},
+		{"lenient missing nonce when supported", withNonce(nil, true), true, ErrNonceMissing},
+		{"lenient mismatching nonce", withNonce("other-nonce", false), true, ErrNonceMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newTestVerifier(t, jwks)
+			auth.requireNonceSupported = tt.requireNonceSupported
+			_, err := auth.VerifyIDTokenWithOptions(context.Background(), tt.idToken, VerifyOptions{ExpectedNonce: "nonce"})
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	auth := newTestVerifier(t, jwks)
+	user, err := auth.VerifyIDTokenWithOptions(context.Background(), withNonce("nonce", true), VerifyOptions{ExpectedNonce: "nonce"})
+	assert.NoError(t, err)
+	assert.True(t, user.NonceSupported)
+	user, err = auth.VerifyIDToken(context.Background(), withNonce(nil, "false"))
+	assert.NoError(t, err)
+	assert.False(t, user.NonceSupported)
+}
+
+func TestVerifyIDToken_NormalizeEmail(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key})
+
+	tests := []struct {
+		name          string
+		email         string
+		opts          []Option
+		expectedEmail string
+		expectedRaw   string
+	}{
+		{"mixed case", "John.Appleseed@Example.COM", []Option{WithNormalizeEmail()}, "john.appleseed@example.com", "John.Appleseed@Example.COM"},
+		{"relay address", "AbC12dEf34@PrivateRelay.AppleID.com", []Option{WithNormalizeEmail()}, "abc12def34@privaterelay.appleid.com", "AbC12dEf34@PrivateRelay.AppleID.com"},
+		{"relay dots kept", "AbC.12dEf34@PrivateRelay.AppleID.com", []Option{WithNormalizeEmail()}, "abc.12def34@privaterelay.appleid.com", "AbC.12dEf34@PrivateRelay.AppleID.com"},
+		{"relay dots stripped", "AbC.12.dEf34@PrivateRelay.AppleID.com", []Option{WithStripRelayDots()}, "abc12def34@privaterelay.appleid.com", "AbC.12.dEf34@PrivateRelay.AppleID.com"},
+		{"non relay dots kept", "John.Appleseed@Example.COM", []Option{WithStripRelayDots()}, "john.appleseed@example.com", "John.Appleseed@Example.COM"},
+		{"disabled", "John.Appleseed@Example.COM", nil, "John.Appleseed@Example.COM", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := newTestClaims()
+			claims["email"] = tt.email
+			idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+			auth := newTestVerifier(t, jwks)
+			for _, opt := range tt.opts {
+				opt(auth)
+			}
+			verified, err := auth.VerifyIDTokenDetailed(context.Background(), idToken)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedEmail, verified.User.Email)
+			assert.Equal(t, tt.expectedRaw, verified.User.RawEmail)
+			assert.Equal(t, tt.expectedEmail, verified.Claims.Email)
+			assert.Contains(t, string(verified.Payload), tt.email)
+		})
+	}
+}
+
+func TestValidateCodeFull_NormalizeEmail(t *testing.T) {
+	key := newTestRSAKey(t)
+	claims := newTestClaims()
+	claims["email"] = "AbC.12dEf34@PrivateRelay.AppleID.com"
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+	auth := newTestVerifier(t, nil)
+	WithStripRelayDots()(auth)
+	auth.httpClient = newTestAppleServer(
+		newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}),
+		&TokenResponse{IDToken: idToken, RefreshToken: "refresh-token", TokenType: "Bearer"},
+	)
+
+	res, err := auth.ValidateCodeFull(context.Background(), "apple-authorization-code", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc12def34@privaterelay.appleid.com", res.User.Email)
+	assert.Equal(t, res.User.Email, res.Claims.Email)
+	assert.Equal(t, "AbC.12dEf34@PrivateRelay.AppleID.com", res.RawClaims["email"])
+}
+
+func TestValidateCodeFull_PartialExchange(t *testing.T) {
+	key := newTestRSAKey(t)
+	claims := newTestClaims()
+	claims["aud"] = "anotherAppID"
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+	auth := newTestVerifier(t, nil)
+	auth.httpClient = newTestAppleServer(
+		newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}),
+		&TokenResponse{IDToken: idToken, RefreshToken: "refresh-token", TokenType: "Bearer"},
+	)
+
+	res, err := auth.ValidateCodeFull(context.Background(), "apple-authorization-code", "")
+	assert.True(t, errors.Is(err, ErrInvalidAudience))
+	var partialErr *PartialExchangeError
+	assert.True(t, errors.As(err, &partialErr))
+	assert.Equal(t, "refresh-token", partialErr.TokenResponse.RefreshToken)
+	assert.Equal(t, "refresh-token", res.TokenResponse.RefreshToken)
+	assert.Nil(t, res.User)
+	assert.Nil(t, res.Claims)
+}
+
+func TestVerifyIDToken_MaxTokenAge(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key})
+	issuedAt := time.Now().Truncate(time.Second)
+	claims := newTestClaims()
+	claims["iat"] = issuedAt.Unix()
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		err  error
+	}{
+		{"fresh", issuedAt.Add(time.Second), nil},
+		{"at the limit", issuedAt.Add(30 * time.Second), nil},
+		{"past the limit", issuedAt.Add(30*time.Second + time.Nanosecond), ErrTokenTooOld},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := tt.now
+			auth := newTestVerifier(t, jwks)
+			auth.clock = func() time.Time { return now }
+			WithMaxTokenAge(30 * time.Second)(auth)
+			_, err := auth.VerifyIDToken(context.Background(), idToken)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestVerifyIDToken_AfterRefresh(t *testing.T) {
+	key := newTestRSAKey(t)
+	// Id tokens returned by the refresh token grant may encode booleans as strings.
+	claims := newTestClaims()
+	claims["email_verified"] = "true"
+	claims["is_private_email"] = "false"
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+	auth := newTestVerifier(t, nil)
+	auth.httpClient = newTestAppleServer(
+		newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}),
+		&TokenResponse{IDToken: idToken, AccessToken: "access-token", TokenType: "Bearer"},
+	)
+
+	tokenResponse, err := auth.ValidateRefreshToken("refresh-token")
+	assert.NoError(t, err)
+	user, err := auth.VerifyIDToken(context.Background(), tokenResponse.IDToken)
+	assert.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+	assert.False(t, user.IsPrivateEmail)
+
+	unverifiedUser, err := GetUserInfoFromIDToken(tokenResponse.IDToken)
+	assert.NoError(t, err)
+	assert.Equal(t, user, unverifiedUser)
+}
+
+func TestVerifyIDToken_EnterpriseClaims(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newTestVerifier(t, newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}))
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+
+	enterpriseClaims := newTestClaims()
+	enterpriseClaims["org_id"] = "8b2f1c7e-0d5a-4c8e-9f3b-2a6d4e1c9b70"
+	verified, err := auth.verifyIDToken(context.Background(), signTestToken(t, key, header, enterpriseClaims), VerifyOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "8b2f1c7e-0d5a-4c8e-9f3b-2a6d4e1c9b70", verified.claims.OrgID)
+
+	verified, err = auth.verifyIDToken(context.Background(), signTestToken(t, key, header, newTestClaims()), VerifyOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, verified.claims.OrgID)
+}
+
+func TestVerifyIDTokenWithOptions_TokenHashes(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key})
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	tokenHash := func(value string) string {
+		sum := sha256.Sum256([]byte(value))
+		return base64.RawURLEncoding.EncodeToString(sum[:16])
+	}
+	hashedClaims := newTestClaims()
+	hashedClaims["c_hash"] = tokenHash("authorization-code")
+	hashedClaims["at_hash"] = tokenHash("access-token")
+	withHashes := signTestToken(t, key, header, hashedClaims)
+	withoutHashes := signTestToken(t, key, header, newTestClaims())
+
+	tests := []struct {
+		name    string
+		idToken string
+		opts    VerifyOptions
+		err     error
+	}{
+		{"hashes absent and not requested", withoutHashes, VerifyOptions{}, nil},
+		{"hashes present and not requested", withHashes, VerifyOptions{}, nil},
+		{"matching hashes", withHashes, VerifyOptions{Code: "authorization-code", AccessToken: "access-token"}, nil},
+		{"mismatching code", withHashes, VerifyOptions{Code: "other-code"}, ErrInvalidCodeHash},
+		{"mismatching access token", withHashes, VerifyOptions{AccessToken: "other-token"}, ErrInvalidAccessTokenHash},
+		{"missing c_hash", withoutHashes, VerifyOptions{Code: "authorization-code"}, ErrInvalidCodeHash},
+		{"missing at_hash", withoutHashes, VerifyOptions{AccessToken: "access-token"}, ErrInvalidAccessTokenHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newTestVerifier(t, jwks)
+			_, err := auth.VerifyIDTokenWithOptions(context.Background(), tt.idToken, tt.opts)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestVerifyIDToken_StaticKeySource(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+	user, err := auth.VerifyIDToken(context.Background(), idToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "001234.abcdef0123456789.0123", user.UID)
+
+	idToken = signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "other-kid"}, newTestClaims())
+	_, err = auth.VerifyIDToken(context.Background(), idToken)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	idToken = signTestToken(t, newTestRSAKey(t), map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+	_, err = auth.VerifyIDToken(context.Background(), idToken)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestVerifyIDToken_WithoutKeyID(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{"kid-1": newTestRSAKey(t), "kid-2": key, "kid-3": newTestRSAKey(t)})
+	header := map[string]interface{}{"alg": "RS256"}
+
+	auth := newTestVerifier(t, jwks)
+	user, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, header, newTestClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "001234.abcdef0123456789.0123", user.UID)
+
+	_, err = auth.VerifyIDToken(context.Background(), signTestToken(t, newTestRSAKey(t), header, newTestClaims()))
+	assert.Equal(t, ErrMissingKeyID, err)
+	assert.True(t, errors.Is(err, ErrNoMatchingKey))
+
+	auth = newTestVerifier(t, newTestJWKS(map[string]*rsa.PrivateKey{"kid-1": key}))
+	_, err = auth.VerifyIDToken(context.Background(), signTestToken(t, newTestRSAKey(t), header, newTestClaims()))
+	assert.Equal(t, ErrNoMatchingKey, err)
+}
+
+func TestGetClaimsFromIDToken_Nonce(t *testing.T) {
+	key := newTestRSAKey(t)
+	for name, nonceSupported := range map[string]interface{}{"bool": true, "string": "true"} {
+		t.Run(name, func(t *testing.T) {
+			claims := newTestClaims()
+			claims["nonce"] = "a-nonce"
+			claims["nonce_supported"] = nonceSupported
+			idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+			idTokenClaims, err := GetClaimsFromIDToken(idToken)
+			assert.NoError(t, err)
+			assert.Equal(t, "a-nonce", idTokenClaims.Nonce)
+			assert.True(t, idTokenClaims.NonceSupported)
+			assert.Equal(t, "001234.abcdef0123456789.0123", idTokenClaims.Subject)
+		})
+	}
+
+	_, err := GetClaimsFromIDToken("not-a-jwt")
+	assert.True(t, errors.Is(err, ErrMalformedIDToken))
+}
+
+func TestExchangeResult_SessionClaims(t *testing.T) {
+	result := ExchangeResult{
+		User: &AppleUser{
+			UID:            "001234.abcdef0123456789.0123",
+			Email:          "anemail@privaterelay.appleid.com",
+			EmailVerified:  true,
+			IsPrivateEmail: true,
+			RealUserStatus: RealUserStatusLikelyReal,
+		},
+		Claims: &IDTokenClaims{ExpiresAt: 1, Nonce: "nonce"},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"sub":              "001234.abcdef0123456789.0123",
+		"email":            "anemail@privaterelay.appleid.com",
+		"email_verified":   true,
+		"is_private_email": true,
+	}, result.SessionClaims())
+
+	result.User.MergeName("John", "")
+	assert.Equal(t, map[string]interface{}{
+		"sub":              "001234.abcdef0123456789.0123",
+		"email":            "anemail@privaterelay.appleid.com",
+		"email_verified":   true,
+		"is_private_email": true,
+		"given_name":       "John",
+	}, result.SessionClaims())
+	result.User.MergeName("", "Appleseed")
+	assert.Equal(t, "Appleseed", result.SessionClaims()["family_name"])
+
+	result.User = &AppleUser{UID: "001234.abcdef0123456789.0123"}
+	assert.Equal(t, map[string]interface{}{"sub": "001234.abcdef0123456789.0123"}, result.SessionClaims())
+
+	partial := ExchangeResult{TokenResponse: &TokenResponse{}}
+	assert.Empty(t, partial.SessionClaims())
+}
+
+func TestVerifyIDToken_ValidateSubjectFormat(t *testing.T) {
+	key := newTestRSAKey(t)
+	source := staticKeySource{testKeyID: &key.PublicKey}
+	tests := []struct {
+		sub      string
+		validate bool
+		err      error
+	}{
+		{"001234.abcdef0123456789.0123", true, nil},
+		{"not a subject", true, ErrInvalidSubject},
+		{"001234..0123", true, ErrInvalidSubject},
+		{"not a subject", false, nil},
+	}
+	for _, test := range tests {
+		var opts []Option
+		if test.validate {
+			opts = append(opts, WithValidateSubjectFormat())
+		}
+		auth := newAppleAuth("appID", "teamID", "keyID", nil, opts...)
+		auth.keySource = source
+		claims := newTestClaims()
+		claims["sub"] = test.sub
+		idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+		_, err := auth.VerifyIDToken(context.Background(), idToken)
+		assert.Equal(t, test.err, err, test.sub)
+	}
+}
+
+func TestVerifyIDTokenWithKeys(t *testing.T) {
+	key := newTestRSAKey(t)
+	jwks := newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key})
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+
+	user, err := VerifyIDTokenWithKeys(idToken, jwks, "appID", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "001234.abcdef0123456789.0123", user.UID)
+
+	user, err = VerifyIDTokenWithKeys(idToken, jwks, "appID", appleAudience)
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+
+	_, err = VerifyIDTokenWithKeys(idToken, jwks, "anotherAppID", "")
+	assert.Equal(t, ErrInvalidAudience, err)
+	_, err = VerifyIDTokenWithKeys(idToken, jwks, "appID", "https://example.com")
+	assert.Equal(t, ErrInvalidIssuer, err)
+	_, err = VerifyIDTokenWithKeys(idToken, newTestJWKS(map[string]*rsa.PrivateKey{"other-kid": key}), "appID", "")
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = VerifyIDTokenWithKeys(idToken, []byte("not json"), "appID", "")
+	assert.Error(t, err)
+}
+
+func TestVerifyIDToken_EmailClaimName(t *testing.T) {
+	key := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	claims := newTestClaims()
+	claims["contact_email"] = "jane@corp.example.com"
+
+	tests := []struct {
+		name          string
+		opts          []Option
+		expectedEmail string
+	}{
+		{"default", nil, "anemail@yourdomain"},
+		{"email", []Option{WithEmailClaimName("email")}, "anemail@yourdomain"},
+		{"custom claim", []Option{WithEmailClaimName("contact_email")}, "jane@corp.example.com"},
+		{"missing claim", []Option{WithEmailClaimName("work_email")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", nil, tt.opts...)
+			auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+			verified, err := auth.VerifyIDTokenDetailed(context.Background(), signTestToken(t, key, header, claims))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedEmail, verified.User.Email)
+			assert.Equal(t, tt.expectedEmail, verified.Claims.Email)
+		})
+	}
+
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithEmailClaimName("contact_email"), WithAllowedEmailDomains("corp.example.com"))
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	_, err := auth.VerifyIDToken(context.Background(), signTestToken(t, key, header, claims))
+	assert.NoError(t, err)
+}
+
+func TestVerifyIDToken_AllowedEmailDomains(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithAllowedEmailDomains("Example.com"))
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	tests := []struct {
+		email          interface{}
+		isPrivateEmail bool
+		err            error
+	}{
+		{"user@example.com", false, nil},
+		{"User@EXAMPLE.COM", false, nil},
+		{"user@example.org", false, ErrEmailDomainNotAllowed},
+		{"user@sub.example.com", false, ErrEmailDomainNotAllowed},
+		{"abc123@privaterelay.appleid.com", true, nil},
+		{"abc123@privaterelay.appleid.com", false, nil},
+		{nil, false, ErrEmailDomainNotAllowed},
+	}
+	for _, test := range tests {
+		claims := newTestClaims()
+		claims["email"] = test.email
+		claims["is_private_email"] = test.isPrivateEmail
+		idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+		_, err := auth.VerifyIDToken(context.Background(), idToken)
+		assert.Equal(t, test.err, err, test.email)
+	}
+}
+
+func TestVerifyIDToken_ClientIDs(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil, WithClientIDs("com.example.web"))
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	for aud, expectedErr := range map[string]error{
+		"appID":             nil,
+		"com.example.web":   nil,
+		"com.example.other": ErrInvalidAudience,
+	} {
+		claims := newTestClaims()
+		claims["aud"] = aud
+		idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, claims)
+
+		_, err := auth.VerifyIDToken(context.Background(), idToken)
+		assert.Equal(t, expectedErr, err, aud)
+	}
+}
+
+func TestVerifyClaimsInto(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	claims := newTestClaims()
+	claims["org_id"] = "org"
+
+	var identity testIdentity
+	err := auth.VerifyClaimsInto(context.Background(), signTestToken(t, key, header, claims), &identity)
+	assert.NoError(t, err)
+	assert.Equal(t, testIdentity{Subject: "001234.abcdef0123456789.0123", Email: "anemail@yourdomain", OrgID: "org"}, identity)
+
+	claims["aud"] = "anotherAppID"
+	identity = testIdentity{}
+	err = auth.VerifyClaimsInto(context.Background(), signTestToken(t, key, header, claims), &identity)
+	assert.Equal(t, ErrInvalidAudience, err)
+	assert.Empty(t, identity)
+}
+
+func TestVerifyIDTokenDetailed(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newAppleAuth("appID", "teamID", "keyID", nil)
+	auth.keySource = staticKeySource{testKeyID: &key.PublicKey}
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	claims := newTestClaims()
+	claims["custom"] = map[string]interface{}{"plan": "pro"}
+
+	verified, err := auth.VerifyIDTokenDetailed(context.Background(), signTestToken(t, key, header, claims))
+	assert.NoError(t, err)
+	assert.Equal(t, testKeyID, verified.KeyID)
+	assert.Equal(t, "RS256", verified.Algorithm)
+	assert.Equal(t, "001234.abcdef0123456789.0123", verified.User.UID)
+	assert.Equal(t, "001234.abcdef0123456789.0123", verified.Claims.Subject)
+	expected, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(verified.Payload))
+
+	claims["aud"] = "anotherAppID"
+	verified, err = auth.VerifyIDTokenDetailed(context.Background(), signTestToken(t, key, header, claims))
+	assert.Equal(t, ErrInvalidAudience, err)
+	assert.Nil(t, verified)
+}
+
+func TestVerifyAndGetUser(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newTestVerifier(t, newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}))
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+
+	user, err := auth.VerifyAndGetUser(context.Background(), signTestToken(t, key, header, newTestClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "001234.abcdef0123456789.0123", user.UID)
+
+	claims := newTestClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = auth.VerifyAndGetUser(context.Background(), signTestToken(t, key, header, claims))
+	assert.Equal(t, ErrTokenExpired, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	auth = newTestVerifier(t, nil)
+	auth.httpClient = &http.Client{Transport: hangingTransport{}}
+	_, err = auth.VerifyAndGetUser(ctx, signTestToken(t, key, header, newTestClaims()))
+	assert.True(t, errors.Is(err, context.Canceled), err)
+}
+
+func TestVerifyBearer(t *testing.T) {
+	key := newTestRSAKey(t)
+	auth := newTestVerifier(t, newTestJWKS(map[string]*rsa.PrivateKey{testKeyID: key}))
+	idToken := signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": testKeyID}, newTestClaims())
+	tests := []struct {
+		name       string
+		authHeader string
+		err        error
+	}{
+		{"valid", "Bearer " + idToken, nil},
+		{"lowercase scheme", "bearer " + idToken, nil},
+		{"surrounding whitespace", "  BEARER   " + idToken + " ", nil},
+		{"missing prefix", idToken, ErrInvalidAuthorizationHeader},
+		{"other scheme", "Basic " + idToken, ErrInvalidAuthorizationHeader},
+		{"scheme only", "Bearer ", ErrInvalidAuthorizationHeader},
+		{"empty", "", ErrInvalidAuthorizationHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := auth.VerifyBearer(context.Background(), tt.authHeader)
+			assert.Equal(t, tt.err, err)
+			if tt.err == nil {
+				assert.Equal(t, newTestClaims()["sub"], user.UID)
+			}
+		})
+	}
+}
+
+func TestUserFromIDToken(t *testing.T) {
+	key := newTestRSAKey(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := newTestClaims()
+		claims[name] = value
+		return claims
+	}
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		err    error
+	}{
+		{"valid", newTestClaims(), nil},
+		{"wrong issuer", withClaim("iss", "https://evil.example.com"), ErrInvalidIssuer},
+		{"wrong audience", withClaim("aud", "anotherAppID"), ErrInvalidAudience},
+		{"expired", withClaim("exp", time.Now().Add(-time.Minute).Unix()), ErrTokenExpired},
+		{"missing expiration", withClaim("exp", nil), ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newAppleAuth("appID", "teamID", "keyID", nil)
+			auth.httpClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+				t.Fatal("unexpected request to Apple")
+				return nil, nil
+			})
+
+			user, err := auth.UserFromIDToken(signTestToken(t, key, header, tt.claims))
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+				assert.Nil(t, user)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "001234.abcdef0123456789.0123", user.UID)
+		})
+	}
+
+	_, err := newAppleAuth("appID", "teamID", "keyID", nil).UserFromIDToken("not-a-jwt")
+	assert.Error(t, err)
+}